@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// artFingerprint identifies the radio calibration data and MAC address that must survive the update
+type artFingerprint struct {
+	region flashRegion
+	crc32  string
+	mac    string
+	// ethaddr is the U-Boot variable, empty if it is not set
+	ethaddr string
+}
+
+// fingerprintArt reads and keeps the ART partition and records the board identity
+func fingerprintArt(r *recipeRun) error {
+	region, ok := r.guard.protectedRegion("art")
+	if !ok {
+		return errors.Errorf("board %s has no ART partition", r.ctx.board.name)
+	}
+	content, err := r.readRegion(region)
+	if err != nil {
+		return errors.Wrap(err, "Read ART")
+	}
+	art := &artFingerprint{region: region, crc32: fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)), ethaddr: r.ethaddr()}
+	if offset := r.ctx.board.flash.macAddr - region.addr; offset >= 0 && offset+6 <= int64(len(content)) {
+		art.mac = formatMAC(content[offset : offset+6])
+	}
+	r.art = art
+	report.MAC = art.mac
+	log.Infof("Board identity: MAC %s, ethaddr %q, ART CRC32 %s", art.mac, art.ethaddr, art.crc32)
+	return nil
+}
+
+// checkArt compares ART and ethaddr with the fingerprint, they are restored if they changed
+func checkArt(r *recipeRun) error {
+	if r.art == nil {
+		return errors.New("ART was not fingerprinted before flashing")
+	}
+	current, err := r.regionCrc(r.art.region)
+	if err != nil {
+		return err
+	}
+	if current != r.art.crc32 {
+		log.Warnf("ART changed during the update, CRC32 %s instead of %s, restoring it", current, r.art.crc32)
+		if err := r.restoreArt(); err != nil {
+			return errors.Wrap(err, "Restore ART")
+		}
+	}
+
+	if r.art.ethaddr != "" {
+		if ethaddr := r.ethaddr(); ethaddr != r.art.ethaddr {
+			log.Warnf("ethaddr changed during the update to %q, restoring %s", ethaddr, r.art.ethaddr)
+			if _, err := r.command("setenv ethaddr "+r.art.ethaddr, 5*time.Second); err != nil {
+				return err
+			}
+			if _, err := r.command("saveenv", 10*time.Second); err != nil {
+				return err
+			}
+		}
+	}
+	log.Infof("ART and MAC address of %s unchanged", r.art.mac)
+	return nil
+}
+
+// ethaddr returns the U-Boot ethaddr variable, empty if it is not set
+func (r *recipeRun) ethaddr() string {
+	output, err := r.command("printenv ethaddr", 5*time.Second)
+	if err != nil {
+		return ""
+	}
+	if match := macPattern.FindStringSubmatch(output); match != nil {
+		return strings.ToLower(match[1])
+	}
+	return ""
+}
+
+// restoreArt writes back the ART read before flashing, through RAM like the other images
+func (r *recipeRun) restoreArt() error {
+	region := r.art.region
+	content := r.saved[region.String()]
+	dir, err := r.backupDir()
+	if err != nil {
+		return err
+	}
+	name := "art-restore.bin"
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+
+	r.ui.SetStatus("Restoring ART...")
+	loadAddr := hexAddr(r.ctx.board.flash.loadAddr)
+	if r.vars["transport"] == "serial" {
+		if err := r.loadSerial(name, content); err != nil {
+			return errors.Wrap(err, "Load the ART backup")
+		}
+	} else {
+		serveFile(name, path)
+		defer serveFile(name, "")
+		output, err := r.command("tftp "+loadAddr+" "+name, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(output, "Bytes transferred = "+strconv.Itoa(len(content))) {
+			return errors.Errorf("unable to load the ART backup from %s", path)
+		}
+	}
+	ram, err := r.regionCrc(flashRegion{"ram", r.ctx.board.flash.loadAddr, region.size})
+	if err != nil {
+		return err
+	}
+	if ram != r.art.crc32 {
+		return errors.Errorf("ART backup corrupted in RAM, CRC32 %s instead of %s", ram, r.art.crc32)
+	}
+
+	r.guard.unlocked[region.name] = true
+	defer delete(r.guard.unlocked, region.name)
+	if _, err := r.writeCommand(fmt.Sprintf("erase %s +%s", hexAddr(region.addr), hexAddr(region.size)), nil, 10*time.Second); err != nil {
+		return err
+	}
+	if _, err := r.writeCommand(fmt.Sprintf("cp.b %s %s %s", loadAddr, hexAddr(region.addr), hexAddr(region.size)), nil, 30*time.Second); err != nil {
+		return err
+	}
+	if restored, err := r.regionCrc(region); err != nil || restored != r.art.crc32 {
+		return errors.Errorf("ART still differs after restore, the backup is in %s", path)
+	}
+	log.Infof("ART restored from %s", path)
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// avrdudeStatus is reported while avrdude runs
+type avrdudeStatus struct {
+	// operation is the current progress bar label: Reading, Writing or Erasing
+	operation string
+	percent   int
+	// signature is the device signature once avrdude has read it
+	signature string
+}
+
+// avrdudeError is returned when avrdude failed for a known reason
+type avrdudeError struct {
+	// line is the avrdude output that identified the failure
+	line        string
+	explanation string
+}
+
+func (e *avrdudeError) Error() string {
+	return e.explanation + " (" + e.line + ")"
+}
+
+// avrdudeFailures maps avrdude messages to explanations, the first matching line wins
+var avrdudeFailures = []struct {
+	pattern     *regexp.Regexp
+	explanation string
+}{
+	{regexp.MustCompile(`programmer is not responding`), "the MCU bootloader is not answering, the board did not enter the bootloader or the USB cable is faulty"},
+	{regexp.MustCompile(`Expected signature for`), "the MCU signature does not match the board profile, check the --board flag"},
+	{regexp.MustCompile(`Invalid device signature`), "the MCU returned an invalid signature, check the wiring or the bootloader"},
+	{regexp.MustCompile(`can't open device|ser_open\(\)`), "the serial port cannot be opened, close any other program using it"},
+	{regexp.MustCompile(`verification error`), "the flash content read back differs from the image"},
+	{regexp.MustCompile(`initialization failed`), "the MCU could not be initialized"},
+	{regexp.MustCompile(`can't open input file|No such file or directory`), "the image file cannot be read"},
+}
+
+var (
+	avrdudeProgressBar = regexp.MustCompile(`(Reading|Writing|Erasing) \| (#*)[ ]*(\| ([0-9]+)%)?`)
+	avrdudeSignature   = regexp.MustCompile(`Device signature = (0x[0-9a-fA-F]+)`)
+)
+
+// execAvrdude runs avrdude with the given args, parsing its progress bars and failures. [status] may be nil.
+// It returns the lines avrdude printed on stdout, where memories read to "-" end up.
+func execAvrdude(binary string, args []string, status func(avrdudeStatus)) ([]string, error) {
+	cmd := exec.Command(binary, args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Retrieve output")
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Retrieve output")
+	}
+
+	log.Infof("Flashing with command: %s %s", binary, strings.Join(args, " "))
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.Wrap(err, "Executing command")
+	}
+
+	var output []string
+	outputDone := make(chan struct{})
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			log.Info(scanner.Text())
+			output = append(output, scanner.Text())
+		}
+		close(outputDone)
+	}()
+
+	// avrdude writes everything, progress bars included, to stderr
+	parser := &avrdudeParser{status: status}
+	parser.parse(stderr)
+	<-outputDone
+
+	err = cmd.Wait()
+	if err != nil {
+		if parser.failure != nil {
+			return output, parser.failure
+		}
+		return output, errors.Wrap(err, "Executing command")
+	}
+	return output, nil
+}
+
+// avrdudeParser follows avrdude output byte by byte, since progress bars are drawn without line breaks
+type avrdudeParser struct {
+	status  func(avrdudeStatus)
+	current avrdudeStatus
+	line    []byte
+	failure *avrdudeError
+}
+
+func (p *avrdudeParser) parse(r io.Reader) {
+	reader := bufio.NewReader(r)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			p.endLine()
+			return
+		}
+		switch b {
+		case '\n', '\r':
+			p.endLine()
+		case '#':
+			p.line = append(p.line, b)
+			p.updateProgress()
+		default:
+			p.line = append(p.line, b)
+		}
+	}
+}
+
+func (p *avrdudeParser) updateProgress() {
+	match := avrdudeProgressBar.FindStringSubmatch(string(p.line))
+	if match == nil {
+		return
+	}
+	// every hash is 2% of the bar
+	percent := len(match[2]) * 2
+	if match[4] != "" {
+		percent, _ = strconv.Atoi(match[4])
+	}
+	if match[1] != p.current.operation || percent != p.current.percent {
+		p.current.operation = match[1]
+		p.current.percent = percent
+		p.notify()
+	}
+}
+
+func (p *avrdudeParser) endLine() {
+	if len(p.line) == 0 {
+		return
+	}
+	p.updateProgress()
+	text := strings.TrimSpace(string(p.line))
+	p.line = p.line[:0]
+	if text == "" {
+		return
+	}
+	log.Info(text)
+
+	if match := avrdudeSignature.FindStringSubmatch(text); match != nil {
+		p.current.signature = match[1]
+		p.notify()
+	}
+	if p.failure != nil {
+		return
+	}
+	for _, failure := range avrdudeFailures {
+		if failure.pattern.MatchString(text) {
+			p.failure = &avrdudeError{line: text, explanation: failure.explanation}
+			log.Warnf("avrdude reported: %s", failure.explanation)
+			return
+		}
+	}
+}
+
+func (p *avrdudeParser) notify() {
+	if p.status != nil {
+		p.status(p.current)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// mcuProfile holds the avrdude settings used to program the board's MCU
+type mcuProfile struct {
+	part       string
+	programmer string
+	baudRate   int
+	// maxSketchSize is the flash available below the bootloader
+	maxSketchSize int
+	// signature is the device signature as printed by avrdude
+	signature string
+	fuses     mcuFuses
+}
+
+// mcuFuses holds the fuse and lock bytes burnt together with the bootloader
+type mcuFuses struct {
+	low      byte
+	high     byte
+	extended byte
+	// extendedMask selects the implemented extended fuse bits, the others read back undefined
+	extendedMask byte
+	unlockBits   byte
+	lockBits     byte
+}
+
+// flashLayout describes the MPU NOR flash, all addresses are absolute
+type flashLayout struct {
+	// size is the smallest flash the layout fits in, the flash starts at bootloaderAddr
+	size           int64
+	loadAddr       int64
+	sectorSize     int64
+	bootloaderAddr int64
+	bootloaderSize int64
+	envAddr        int64
+	envSize        int64
+	firmwareAddr   int64
+	firmwareSize   int64
+	// kernelLoadAddr is the RAM address sysupgrade kernels must be built for
+	kernelLoadAddr int64
+	// protected regions are never erased nor written
+	protected []flashRegion
+	// macAddr is where the board MAC address is stored
+	macAddr int64
+}
+
+// ubootProfile holds the U-Boot prompts expected from the board
+type ubootProfile struct {
+	// stopPattern matches every known autoboot banner, the stop word is its last non empty submatch,
+	// banners without a stop word are stopped by any key
+	stopPattern string
+	// shell is the prompt name of the bootloader shipped with the updater
+	shell string
+	// stopWord interrupts autoboot of the bootloader shipped with the updater
+	stopWord string
+}
+
+// boardImages lists the default images flashed to the board
+type boardImages struct {
+	bootloader  string
+	sysupgrade  string
+	terminalHex string
+	firmwareHex string
+	// mcuBootloaderHex is the Caterina bootloader burnt through ISP during recovery
+	mcuBootloaderHex string
+	// sysupgradeDevices are the fwtool supported_devices names accepted for the sysupgrade image
+	sysupgradeDevices []string
+}
+
+// boardProfile groups every board specific fact used during the update
+type boardProfile struct {
+	name string
+	// envName is written into the board U-Boot environment
+	envName string
+	// recipe is the flash recipe file in the recipes directory
+	recipe string
+	// linuxRecipe updates the board from its Linux shell with sysupgrade, empty if not supported
+	linuxRecipe string
+	mcu         mcuProfile
+	flash       flashLayout
+	uboot       ubootProfile
+	images      boardImages
+	// variants are the profiles of boards sharing this layout and images, their USB devices are flashed too
+	variants []string
+}
+
+var atmega32u4 = mcuProfile{
+	part:          "atmega32u4",
+	programmer:    "avr109",
+	baudRate:      57600,
+	maxSketchSize: 28672,
+	signature:     "0x1e9587",
+	fuses:         mcuFuses{low: 0xff, high: 0xd8, extended: 0xcb, extendedMask: 0x0f, unlockBits: 0x3f, lockBits: 0x2f},
+}
+
+// ar9331Flash is the 16MB NOR layout shared by all AR9331 based boards
+var ar9331Flash = flashLayout{
+	size:           0x1000000,
+	loadAddr:       0x80060000,
+	sectorSize:     0x10000,
+	bootloaderAddr: 0x9f000000,
+	bootloaderSize: 0x40000,
+	envAddr:        0x9f040000,
+	envSize:        0x10000,
+	firmwareAddr:   0x9f050000,
+	firmwareSize:   0xfa0000,
+	kernelLoadAddr: 0x80060000,
+	// ART holds the radio calibration data and the MAC addresses
+	protected: []flashRegion{{"art", 0x9fff0000, 0x10000}},
+	macAddr:   0x9fff0000,
+}
+
+var ledeUboot = ubootProfile{
+	stopPattern: "stop with '([a-z]+)'|Hit any key to stop autoboot|type '([a-z]+)' to enter u-boot console",
+	shell:       "arduino",
+	stopWord:    "ard",
+}
+
+// yunImages are shared by the Yun and the Yun Rev2, the same board with other USB ids
+var yunImages = boardImages{
+	bootloader:        "u-boot-arduino-lede.bin",
+	sysupgrade:        "openwrt-ar71xx-generic-arduino-yun-squashfs-sysupgrade.bin",
+	terminalHex:       "mcu_serial_terminal.hex",
+	firmwareHex:       "mcu_firmware.hex",
+	mcuBootloaderHex:  "Caterina-Yun.hex",
+	sysupgradeDevices: []string{"arduino-yun"},
+}
+
+// no bootloader nor sysupgrade image is shipped yet for the other boards, only their MCU can be handled
+var yunMiniImages = boardImages{
+	terminalHex:      "mcu_serial_terminal.hex",
+	firmwareHex:      "mcu_firmware.hex",
+	mcuBootloaderHex: "Caterina-YunMini.hex",
+}
+
+var lininoOneImages = boardImages{
+	terminalHex:      "mcu_serial_terminal.hex",
+	firmwareHex:      "mcu_firmware.hex",
+	mcuBootloaderHex: "Caterina-LininoOne.hex",
+}
+
+var industrial101Images = boardImages{
+	terminalHex:      "mcu_serial_terminal.hex",
+	firmwareHex:      "mcu_firmware.hex",
+	mcuBootloaderHex: "Caterina-Industrial101.hex",
+}
+
+var boardProfiles = []boardProfile{
+	{
+		name:        "Yun",
+		envName:     "Yun",
+		recipe:      "yun.json",
+		linuxRecipe: "yun-linux.json",
+		mcu:         atmega32u4,
+		flash:       ar9331Flash,
+		uboot:       ledeUboot,
+		images:      yunImages,
+		// the default board must keep finding the Yun Rev2 ids
+		variants: []string{"YunRev2"},
+	},
+	{
+		name:        "YunRev2",
+		envName:     "Yun",
+		recipe:      "yun.json",
+		linuxRecipe: "yun-linux.json",
+		mcu:         atmega32u4,
+		flash:       ar9331Flash,
+		uboot:       ledeUboot,
+		images:      yunImages,
+	},
+	{
+		name:        "YunMini",
+		envName:     "Yun-Mini",
+		recipe:      "yun.json",
+		linuxRecipe: "yun-linux.json",
+		mcu:         atmega32u4,
+		flash:       ar9331Flash,
+		uboot:       ledeUboot,
+		images:      yunMiniImages,
+	},
+	{
+		name:        "LininoOne",
+		envName:     "Linino-One",
+		recipe:      "yun.json",
+		linuxRecipe: "yun-linux.json",
+		mcu:         atmega32u4,
+		flash:       ar9331Flash,
+		uboot:       ledeUboot,
+		images:      lininoOneImages,
+	},
+	{
+		name:        "Industrial101",
+		envName:     "Industrial-101",
+		recipe:      "yun.json",
+		linuxRecipe: "yun-linux.json",
+		mcu:         atmega32u4,
+		flash:       ar9331Flash,
+		uboot:       ledeUboot,
+		images:      industrial101Images,
+	},
+}
+
+// findBoardProfile returns the registered profile with the given name, names are case insensitive
+func findBoardProfile(name string) (*boardProfile, error) {
+	for i := range boardProfiles {
+		if strings.EqualFold(boardProfiles[i].name, name) {
+			return &boardProfiles[i], nil
+		}
+	}
+	return nil, errors.Errorf("unknown board %q, supported boards: %s", name, strings.Join(boardNames(), ", "))
+}
+
+// accepts returns true if the board profile can flash a USB device registered for the given profile
+func (b *boardProfile) accepts(profile string) bool {
+	return profile == b.name || containsString(b.variants, profile)
+}
+
+// checkMpuImages rejects boards without the bootloader and sysupgrade images needed to flash the MPU
+func (b *boardProfile) checkMpuImages() error {
+	if b.images.bootloader == "" || b.images.sysupgrade == "" {
+		return errors.Errorf("no bootloader and sysupgrade images for board %s yet, only console, env and isp are supported", b.name)
+	}
+	return nil
+}
+
+// boardNames returns the sorted names of all registered profiles
+func boardNames() []string {
+	names := make([]string, 0, len(boardProfiles))
+	for _, profile := range boardProfiles {
+		names = append(names, profile.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sectors returns the number of flash sectors covered by size bytes
+func (f flashLayout) sectors(size int64) int64 {
+	return (size + f.sectorSize - 1) / f.sectorSize
+}
+
+// hexAddr formats the value the way U-Boot commands expect it
+func hexAddr(value int64) string {
+	return fmt.Sprintf("0x%x", value)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const bootLogFileName = "boot_log.txt"
+
+var (
+	// bootEndPattern matches a kernel panic (1), a console waiting for Enter or a login (2) or the root shell
+	bootEndPattern     = regexp.MustCompile(`(Kernel panic[^\r\n]*|VFS: Unable to mount root fs[^\r\n]*)|(Please press Enter to activate this console|login: )|root@[^\s:]+:[^\r\n]*# `)
+	panicEndPattern    = regexp.MustCompile(`end Kernel panic|Rebooting in`)
+	releaseLinePattern = regexp.MustCompile(`(?m)^(DISTRIB_[A-Z]+)='?([^'\r\n]*)'?`)
+	unamePattern       = regexp.MustCompile(`Linux \S+ (\S+)`)
+)
+
+// bootReport describes the Linux system found on the board after flashing
+type bootReport struct {
+	Release string `json:"release,omitempty"`
+	Kernel  string `json:"kernel,omitempty"`
+	Log     string `json:"log"`
+}
+
+// parseRelease returns the distribution, release and revision of /etc/openwrt_release, formatted like
+// the sysupgrade image version
+func parseRelease(output string) string {
+	fields := map[string]string{}
+	for _, match := range releaseLinePattern.FindAllStringSubmatch(output, -1) {
+		fields[match[1]] = match[2]
+	}
+	return strings.TrimSpace(strings.Join([]string{fields["DISTRIB_ID"], fields["DISTRIB_RELEASE"], fields["DISTRIB_REVISION"]}, " "))
+}
+
+// bootMatchesImage compares the booted system with the image version, which is the uImage name
+// (e.g. "MIPS LEDE Linux-4.4.61") for images without metadata
+func bootMatchesImage(version, release, kernel string) bool {
+	return version == release || (kernel != "" && strings.HasSuffix(version, "Linux-"+kernel))
+}
+
+// verifyBoot follows the console until Linux is up, then checks the running release against the
+// flashed image; the boot log is saved whatever the outcome
+func verifyBoot(r *recipeRun) error {
+	boot := &bootReport{Log: bootLogFileName}
+	report.Boot = boot
+	bootLog := strings.Builder{}
+	defer func() {
+		if err := ioutil.WriteFile(bootLogFileName, []byte(bootLog.String()), 0644); err != nil {
+			log.Errorf("Unable to save boot log: %s", err.Error())
+		}
+	}()
+
+	r.ui.SetStatus("Waiting for Linux to boot...")
+	timeout := 3 * time.Minute
+	if r.stage != nil && r.stage.Timeout > 0 {
+		timeout = stageTimeout(*r.stage, r.ctx)
+	}
+	output, match, err := r.exp.Expect(bootEndPattern, timeout)
+	bootLog.WriteString(output)
+	if err != nil {
+		return errors.Wrap(err, "Linux did not boot")
+	}
+	if match[1] != "" {
+		trace, _, _ := r.exp.Expect(panicEndPattern, 5*time.Second)
+		bootLog.WriteString(trace)
+		return errors.Errorf("Linux failed to boot: %s, see %s", strings.TrimSpace(match[1]), bootLogFileName)
+	}
+	if match[2] == "login: " {
+		log.Warn("Linux asks for a login, the booted release is not checked")
+		r.vars["linux_release"] = "booted, login required"
+		return nil
+	}
+	if match[2] != "" {
+		// activate the console
+		output, err = r.linuxCommand("", 10*time.Second)
+		bootLog.WriteString(output)
+		if err != nil {
+			return err
+		}
+	}
+
+	results := map[string]string{}
+	for _, command := range []string{"cat /etc/openwrt_release", "uname -a", "df"} {
+		output, err := r.linuxCommand(command, 10*time.Second)
+		bootLog.WriteString(output)
+		if err != nil {
+			return err
+		}
+		results[command] = output
+	}
+	boot.Release = parseRelease(results["cat /etc/openwrt_release"])
+	if match := unamePattern.FindStringSubmatch(results["uname -a"]); match != nil {
+		boot.Kernel = match[1]
+	}
+	log.Infof("Linux booted: %s, kernel %s", boot.Release, boot.Kernel)
+	for _, line := range strings.Split(strings.TrimSpace(results["df"]), "\n") {
+		log.Infof("df: %s", strings.TrimSpace(line))
+	}
+
+	version := r.ctx.sysupgradeFirmware.version
+	if !bootMatchesImage(version, boot.Release, boot.Kernel) {
+		return errors.Errorf("booted %q (kernel %s), flashed %q", boot.Release, boot.Kernel, version)
+	}
+	r.vars["linux_release"] = boot.Release
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	expect "github.com/facchinm/goexpect"
+	log "github.com/sirupsen/logrus"
+)
+
+// terminalSpeed is a baud rate command understood by the serial terminal sketch, "~" followed by key
+type terminalSpeed struct {
+	key      string
+	baudRate int
+}
+
+// terminalSpeeds lists the sketch commands, the console speed comes first
+var terminalSpeeds = []terminalSpeed{
+	{"1", 115200},
+	{"2", 250000},
+	{"0", 57600},
+	{"3", 500000},
+	{"4", 9600},
+}
+
+// bridgeError tells why the MCU serial bridge does not reach the MPU console
+type bridgeError struct {
+	reason string
+}
+
+func (e *bridgeError) Error() string {
+	return e.reason
+}
+
+var (
+	errSketchNotRunning = &bridgeError{"MCU not running the serial terminal sketch: it did not answer the speed command, try to flash it again"}
+	errMpuSilent        = &bridgeError{"MPU silent: nothing received from the MPU console, check that the board is powered and the MPU is running"}
+)
+
+// consoleSample matches whatever the console prints first
+var consoleSample = regexp.MustCompile(`(?s).{16}`)
+
+// CheckSerialBridge verifies that the serial terminal sketch is running and bridging a readable MPU console
+func CheckSerialBridge(exp expect.Expecter) error {
+	if !setTerminalSpeed(exp, terminalSpeeds[0]) {
+		return errSketchNotRunning
+	}
+	output := sampleConsole(exp)
+	if output == "" {
+		return errMpuSilent
+	}
+	if isReadable(output) {
+		log.Infof("MPU console answered: %q", output)
+		return nil
+	}
+
+	// garbage on the console, look for the speed the MPU is actually using
+	log.Infof("Unreadable MPU console at %d: %q", terminalSpeeds[0].baudRate, output)
+	found := 0
+	for _, speed := range terminalSpeeds[1:] {
+		if setTerminalSpeed(exp, speed) && isReadable(sampleConsole(exp)) {
+			found = speed.baudRate
+			break
+		}
+	}
+	setTerminalSpeed(exp, terminalSpeeds[0])
+	if found != 0 {
+		return &bridgeError{"wrong baud rate: the MPU console answers at " + strconv.Itoa(found) + " instead of " + strconv.Itoa(terminalSpeeds[0].baudRate) + ", reset the board to enter U-Boot"}
+	}
+	return &bridgeError{"wrong baud rate: the MPU console is unreadable at every speed the sketch supports"}
+}
+
+// setTerminalSpeed changes the sketch baud rate towards the MPU, returns false if the sketch did not confirm
+func setTerminalSpeed(exp expect.Expecter, speed terminalSpeed) bool {
+	_, err := exp.ExpectBatch([]expect.Batcher{
+		&expect.BSnd{S: "~" + speed.key},
+		&expect.BExp{R: "Speed set to " + strconv.Itoa(speed.baudRate)},
+	}, time.Duration(3)*time.Second)
+	return err == nil
+}
+
+// sampleConsole pokes the MPU console and returns what came back, possibly nothing
+func sampleConsole(exp expect.Expecter) string {
+	if err := exp.Send("\n"); err != nil {
+		return ""
+	}
+	// on timeout the expecter still returns what it has read so far
+	output, _, _ := exp.Expect(consoleSample, time.Duration(3)*time.Second)
+	return output
+}
+
+// isReadable returns true if most of the output is printable text, a wrong baud rate produces binary noise
+func isReadable(output string) bool {
+	printable := 0
+	total := 0
+	for _, r := range output {
+		total++
+		if r != utf8.RuneError && (unicode.IsPrint(r) || unicode.IsSpace(r)) {
+			printable++
+		}
+	}
+	return total > 0 && printable*10 >= total*8
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	expect "github.com/facchinm/goexpect"
+	jobsui "github.com/mic90/go-jobs-ui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	serial "go.bug.st/serial.v1"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+const (
+	// consoleEscape opens the console menu, Ctrl-] like telnet
+	consoleEscape = 0x1d
+	// consoleInterrupt is Ctrl-C, a real break cannot cross the serial terminal sketch
+	consoleInterrupt = 0x03
+	// consoleRecent is the console output kept to find the autoboot banner
+	consoleRecent = 4096
+)
+
+const consoleMenu = "b: send Ctrl-C, s: stop the next autoboot, 0-4: MPU baud rate, q: quit, Ctrl-]: send Ctrl-], any other key: back"
+
+// consoleSession bridges the local terminal to the MPU console through the serial terminal sketch
+type consoleSession struct {
+	port        io.ReadWriter
+	out         io.Writer
+	stopPattern *regexp.Regexp
+	sync.Mutex
+	// recent is the tail of the console output since the last autoboot banner
+	recent []byte
+	// stop is the stop word of the last autoboot banner, stopArmed sends it at the next one
+	stop      string
+	stopArmed bool
+}
+
+// send writes to the board console
+func (c *consoleSession) send(data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	_, err := c.port.Write(data)
+	return err
+}
+
+// notice prints a message of the updater between the console output
+func (c *consoleSession) notice(format string, args ...interface{}) {
+	fmt.Fprintf(c.out, "\r\n[console] %s\r\n", fmt.Sprintf(format, args...))
+}
+
+// pump copies the console output to the terminal until the port is closed
+func (c *consoleSession) pump() error {
+	buf := make([]byte, 1024)
+	for {
+		n, err := c.port.Read(buf)
+		if n > 0 {
+			c.out.Write(buf[:n])
+			c.watch(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watch looks for the autoboot banner, it is stopped with the word the banner asks for once armed
+func (c *consoleSession) watch(data []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.recent = append(c.recent, data...)
+	if len(c.recent) > consoleRecent {
+		c.recent = c.recent[len(c.recent)-consoleRecent:]
+	}
+	match := c.stopPattern.FindStringSubmatch(string(c.recent))
+	if match == nil {
+		return
+	}
+	c.recent = c.recent[:0]
+	c.stop = captureValue(match, -1)
+	if !c.stopArmed {
+		return
+	}
+	c.stopArmed = false
+	if _, err := c.port.Write([]byte(c.stop + "\n")); err != nil {
+		c.notice("unable to stop autoboot: %s", err.Error())
+		return
+	}
+	if c.stop == "" {
+		c.notice("autoboot stopped")
+	} else {
+		c.notice("autoboot stopped with %q", c.stop)
+	}
+	log.Infof("Console: autoboot stopped with %q", c.stop)
+}
+
+// run forwards the keys typed to the console, Ctrl-] opens the menu, until quit is chosen
+func (c *consoleSession) run(in io.Reader) error {
+	key := make([]byte, 1)
+	menu := false
+	for {
+		if _, err := in.Read(key); err != nil {
+			return errors.Wrap(err, "Read keyboard")
+		}
+		if !menu {
+			if key[0] == consoleEscape {
+				menu = true
+				c.notice(consoleMenu)
+				continue
+			}
+			if err := c.send(key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		menu = false
+		switch {
+		case key[0] == 'q':
+			return nil
+		case key[0] == 'b':
+			if err := c.send([]byte{consoleInterrupt}); err != nil {
+				return err
+			}
+			c.notice("sent Ctrl-C")
+		case key[0] == 's':
+			c.Lock()
+			c.stopArmed = true
+			c.Unlock()
+			c.notice("the next autoboot will be stopped, reset the board if needed")
+		case key[0] == consoleEscape:
+			if err := c.send(key); err != nil {
+				return err
+			}
+		default:
+			speed, ok := terminalSpeedFor(key[0])
+			if !ok {
+				c.notice("back to the console")
+				continue
+			}
+			// the sketch answers "Speed set to N"
+			if err := c.send([]byte("~" + speed.key)); err != nil {
+				return err
+			}
+			log.Infof("Console: MPU baud rate set to %d", speed.baudRate)
+		}
+	}
+}
+
+// terminalSpeedFor returns the serial terminal sketch speed selected by the key
+func terminalSpeedFor(key byte) (terminalSpeed, bool) {
+	for _, speed := range terminalSpeeds {
+		if speed.key == string(key) {
+			return speed, true
+		}
+	}
+	return terminalSpeed{}, false
+}
+
+// terminalSketchRunning returns true if the serial terminal sketch answers on the port
+func terminalSketchRunning(port string) bool {
+	exp, _, err, serport := serialSpawn(port, time.Duration(10)*time.Second, expect.CheckDuration(100*time.Millisecond))
+	if err != nil {
+		return false
+	}
+	running := setTerminalSpeed(exp, terminalSpeeds[0])
+	exp.Close()
+	serport.Close()
+	return running
+}
+
+// runConsole attaches the terminal to the MPU console, flashing the serial terminal sketch if it is not running,
+// the session is recorded like the updater ones
+func runConsole(ui *jobsui.UI, board *boardProfile, usbDevices usbDatabase, selector *portSelector, terminalImage *mcuImage) {
+	ui.AddJob("findSerialPort", "Find serial port for upload")
+	ui.AddJob("uploadTerminalHex", "Flash MCU with serial terminal")
+
+	stopPattern, err := regexp.Compile(board.uboot.stopPattern)
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		waitForKeyAndExit(ui, "console needs an interactive terminal")
+	}
+
+	serialPortName, device, err := findSerialPortForFlashing(board, usbDevices, selector)
+	if err != nil {
+		ui.SetJobStateWithInfo("findSerialPort", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, "unable to find serial port for flashing")
+	}
+	ui.SetJobStateWithInfo("findSerialPort", jobsui.Done, serialPortName+" ("+device.Name+")")
+	report.SerialNumber = selector.serialNumber
+
+	port := serialPortName
+	ui.SetStatus("Checking the serial terminal sketch...")
+	if terminalSketchRunning(port) {
+		ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Skipped, "already running")
+	} else {
+		ui.SetStatus(fmt.Sprintf("Flashing hex file: %s", terminalImage.name))
+		port, err = FlashHexFile(serialPortName, terminalImage, board.mcu, avrdudeStatusToUI(ui, terminalImage.name))
+		if err != nil {
+			ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Error, err.Error())
+			log.Error(err)
+			waitForKeyAndExit(ui, fmt.Sprintf("unable to flash %s", terminalImage.name))
+		}
+		port = selector.resolve(port)
+		ui.SetJobState("uploadTerminalHex", jobsui.Done)
+	}
+
+	serPort, err := serial.Open(port, &serial.Mode{BaudRate: 115200})
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, errors.Wrapf(err, "Open port %s", port).Error())
+	}
+	var conn io.ReadWriter = serPort
+	recorder, err := newSerialRecorder(serPort, port)
+	if err != nil {
+		log.Warn(err)
+	} else {
+		conn = recorder
+		defer recorder.Close()
+	}
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		serPort.Close()
+		log.Error(err)
+		waitForKeyAndExit(ui, errors.Wrap(err, "Set terminal raw mode").Error())
+	}
+	session := &consoleSession{port: conn, out: os.Stdout, stopPattern: stopPattern}
+	session.notice("connected to the MPU console on %s, Ctrl-] opens the menu", port)
+	if report.Transcript != "" {
+		session.notice("session recorded in %s", report.Transcript)
+	}
+	log.Infof("Console attached on %s", port)
+	go session.pump()
+	err = session.run(os.Stdin)
+	terminal.Restore(fd, state)
+	serPort.Close()
+	if err != nil {
+		log.Error(err)
+	}
+	log.Info("Console detached")
+	report.save()
+	fmt.Println("\nThe serial terminal sketch is still on the MCU, run the updater or upload a sketch to replace it")
+}
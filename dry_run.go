@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jobsui "github.com/mic90/go-jobs-ui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const dryRunFileName = "updater_plan.txt"
+
+// recipeHookVariables are the variables set by the hooks from what they find on the board
+var recipeHookVariables = map[string][]string{
+	"detect_flash":      {"flash_size"},
+	"backup_flash":      {"backup_dir"},
+	"verify_boot":       {"linux_release"},
+	"md_crc32_ram":      {"ram_crc32"},
+	"md_crc32_flash":    {"flash_crc32"},
+	"fingerprint_uboot": append([]string{"uboot.name", "uboot.current"}, prefixAll("uboot.", ubootCapabilities)...),
+}
+
+func prefixAll(prefix string, names []string) []string {
+	prefixed := []string{}
+	for _, name := range names {
+		prefixed = append(prefixed, prefix+name)
+	}
+	return prefixed
+}
+
+// recipePlan walks a recipe without a board: variables only known on the board are kept as {{name}}
+// and the stages and steps depending on them are listed with their conditions
+type recipePlan struct {
+	ctx     *context
+	vars    map[string]string
+	unknown map[string]bool
+	guard   *flashGuard
+	lines   []string
+}
+
+func newRecipePlan(ctx *context) *recipePlan {
+	plan := &recipePlan{ctx: ctx, vars: recipeVariables(*ctx), unknown: map[string]bool{}, guard: newFlashGuard(ctx.board.flash)}
+	if ctx.httpPort == 0 {
+		// the port is chosen when the HTTP server starts
+		plan.forget("http_port")
+	}
+	return plan
+}
+
+func (p *recipePlan) addf(format string, args ...interface{}) {
+	p.lines = append(p.lines, fmt.Sprintf(format, args...))
+}
+
+// forget marks the variables as known only on the board
+func (p *recipePlan) forget(names ...string) {
+	for _, name := range names {
+		p.unknown[name] = true
+		p.vars[name] = "{{" + name + "}}"
+	}
+}
+
+// decide evaluates the condition, decided is false when it depends on the board
+func (p *recipePlan) decide(condition string) (holds, decided bool) {
+	for _, match := range recipeVariable.FindAllStringSubmatch(condition, -1) {
+		if p.unknown[match[1]] {
+			return false, false
+		}
+	}
+	holds, _ = evalCondition(condition, p.vars)
+	return holds, true
+}
+
+// stage adds the stage commands to the plan
+func (p *recipePlan) stage(stage recipeStage) {
+	runs, undecided := len(stage.When) == 0, []string{}
+	for _, condition := range stage.When {
+		holds, decided := p.decide(condition)
+		runs = runs || holds
+		if !decided {
+			undecided = append(undecided, condition)
+		}
+	}
+	if !runs && len(undecided) == 0 {
+		p.addf("  stage %s: skipped", stage.Name)
+		return
+	}
+	header := "  stage " + stage.Name
+	if !runs {
+		header += ", if " + strings.Join(undecided, " or ")
+	}
+	header += ", timeout " + stageTimeout(stage, p.ctx).String()
+	if stage.Retries > 0 {
+		header += fmt.Sprintf(", %d retries", stage.Retries)
+	}
+	if stage.Optional {
+		header += ", optional"
+	}
+	p.addf("%s:", header)
+
+	vars := bindImage(stage.Image, p.vars)
+	env := imageEnv(stage, p.ctx)
+	for _, step := range stage.Steps {
+		indent := "    "
+		if step.When != "" {
+			holds, decided := p.decide(step.When)
+			if decided && !holds {
+				continue
+			}
+			if !decided {
+				indent += "if " + step.When + ": "
+			}
+		}
+		switch {
+		case step.Sleep > 0:
+			p.addf("%ssleep %ds", indent, step.Sleep)
+		case step.Check != "":
+			check, _ := expandVariables(step.Check, vars)
+			p.addf("%scheck %s", indent, check)
+		case step.Show != "":
+		case step.Call != "":
+			p.addf("%scall %s", indent, step.Call)
+			p.hook(step.Call, vars)
+			p.forget(recipeHookVariables[step.Call]...)
+			vars = bindImage(stage.Image, p.vars)
+		case step.Send != nil:
+			text, _ := expandVariables(*step.Send, vars)
+			line := indent + "> " + text
+			if write, ok, err := parseWriteCommand(text, env); err == nil && ok {
+				line += fmt.Sprintf("    # %s %s-%s in %s", write.name, hexAddr(write.addr), hexAddr(write.end()), p.guard.regionOf(write))
+			}
+			p.lines = append(p.lines, line)
+		default:
+			pattern, _ := expandVariables(step.Expect, vars)
+			p.addf("%s< %s", indent, pattern)
+			for name := range step.Capture {
+				p.forget(name)
+			}
+			vars = bindImage(stage.Image, p.vars)
+		}
+	}
+
+	// the outcome of optional or conditional stages is only known on the board
+	for _, set := range []map[string]string{stage.Set, stage.SetFailed} {
+		for name, value := range set {
+			expanded, _ := expandVariables(value, p.vars)
+			if runs && !stage.Optional && !strings.Contains(expanded, "{{") {
+				p.vars[name] = expanded
+				delete(p.unknown, name)
+			} else {
+				p.forget(name)
+			}
+		}
+	}
+}
+
+// hook describes the commands the hook sends itself
+func (p *recipePlan) hook(name string, vars map[string]string) {
+	switch name {
+	case "backup_flash":
+		for _, region := range p.ctx.backupRegions {
+			p.addf("      read %s to %s", region, backupRootDir)
+		}
+	case "load_serial":
+		p.addf("      > loadb %s, then %s over Kermit", vars["load_addr"], vars["image.name"])
+	case "md_crc32_ram":
+		p.addf("      md.b %s %s, CRC32 computed on the host", vars["load_addr"], vars["image.size_hex"])
+	case "md_crc32_flash":
+		p.addf("      md.b %s %s, CRC32 computed on the host", vars["image.addr"], vars["image.size_hex"])
+	case "upload_linux":
+		p.addf("      printf %s to %s in %d byte chunks", vars["image.name"], linuxUploadDir, linuxUploadChunk)
+	}
+}
+
+// planRecipe returns the commands the recipe sends, as far as they are known without a board
+func planRecipe(recipe *flashRecipe, ctx context) []string {
+	plan := newRecipePlan(&ctx)
+	for _, stage := range recipe.Stages {
+		plan.stage(stage)
+	}
+	return plan.lines
+}
+
+// runDryRun resolves the network, the serial port and the images like a real run, then saves the
+// sequence of avrdude and U-Boot commands the run would perform without touching the board
+func runDryRun(ui *jobsui.UI, ctx context, defaultServerAddr, defaultBoardAddr string, usbDevices usbDatabase, selector *portSelector, terminalImage, firmwareImage *mcuImage) {
+	ui.SetStatus("Dry run, planning...")
+	lines := []string{fmt.Sprintf("Dry run plan for %s, %s", ctx.board.name, time.Now().Format(time.RFC3339)), ""}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	add("Images:")
+	add("  MCU serial terminal %s: %d bytes, sha256 %s", terminalImage.path, terminalImage.size, terminalImage.checksum)
+	add("  MCU firmware %s: %d bytes, sha256 %s", firmwareImage.path, firmwareImage.size, firmwareImage.checksum)
+	for _, image := range []firmwareFile{ctx.bootloaderFirmware, ctx.sysupgradeFirmware} {
+		add("  %s: %d bytes, CRC32 %s, MD5 %s %s", image.name, image.size, image.crc32, image.md5, image.version)
+	}
+
+	ctx.serverAddr, ctx.ipAddr = defaultServerAddr, defaultBoardAddr
+	if ctx.transport == "tftp" && (ctx.serverAddr == "" || ctx.ipAddr == "") {
+		if err := GetServerAndBoardIP(&ctx.serverAddr, &ctx.ipAddr); err != nil {
+			add("Network: %s, the run falls back to serial transfer", err.Error())
+			ctx.transport = "serial"
+		}
+	}
+	if ctx.transport == "tftp" {
+		add("Network: TFTP server on %s:69, board address %s", ctx.serverAddr, ctx.ipAddr)
+	} else {
+		add("Network: none, images are sent over the serial console")
+	}
+
+	port, device, err := findSerialPortForFlashing(ctx.board, usbDevices, selector)
+	if err != nil {
+		add("Serial port: %s", err.Error())
+		port = "PORT"
+	} else {
+		add("Serial port: %s (%s)", port, device.Name)
+	}
+
+	execDir, _ := os.Executable()
+	binDir := filepath.Join(filepath.Dir(execDir), "avr")
+	add("")
+	add("1. Reset %s at 1200 bps into the MCU bootloader", port)
+	add("2. %s %s", avrdudeBinary(binDir), strings.Join(avrdudeFlashArgs(binDir, terminalImage, ctx.board.mcu, port), " "))
+	add("3. Check the MCU serial bridge, reboot the MPU into U-Boot")
+	switch {
+	case ctx.mode == "linux":
+		add("4. Recipe %s:", ctx.linuxRecipe.Name)
+		lines = append(lines, planRecipe(ctx.linuxRecipe, ctx)...)
+	case ctx.mode == "auto" && ctx.linuxRecipe != nil:
+		add("4. If the board runs Linux and its bootloader needs no flashing, recipe %s:", ctx.linuxRecipe.Name)
+		lines = append(lines, planRecipe(ctx.linuxRecipe, ctx)...)
+		add("   Otherwise recipe %s:", ctx.recipe.Name)
+		lines = append(lines, planRecipe(ctx.recipe, ctx)...)
+	default:
+		add("4. Recipe %s:", ctx.recipe.Name)
+		lines = append(lines, planRecipe(ctx.recipe, ctx)...)
+	}
+	add("5. Reset %s at 1200 bps into the MCU bootloader", port)
+	add("6. %s %s", avrdudeBinary(binDir), strings.Join(avrdudeFlashArgs(binDir, firmwareImage, ctx.board.mcu, port), " "))
+
+	for _, line := range lines {
+		log.Info(line)
+	}
+	if err := ioutil.WriteFile(dryRunFileName, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, errors.Wrap(err, "Save plan").Error())
+	}
+	ui.SetStatus("Dry run done, nothing was written, see " + dryRunFileName + ". You may now close the window, or wait 10s")
+	time.Sleep(10 * time.Second)
+}
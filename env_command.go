@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	expect "github.com/facchinm/goexpect"
+	jobsui "github.com/mic90/go-jobs-ui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const envDumpFileName = "uboot_env.txt"
+
+// envCommand is a parsed "env dump", "env get NAME" or "env set NAME [VALUE...]" command
+type envCommand struct {
+	action string
+	name   string
+	value  string
+}
+
+// parseEnvCommand validates the env subcommand arguments before touching the hardware
+func parseEnvCommand(args []string) (envCommand, error) {
+	usage := errors.New("usage: env dump | env get NAME | env set NAME [VALUE...]")
+	if len(args) == 0 {
+		return envCommand{}, usage
+	}
+	command := envCommand{action: args[0]}
+	switch {
+	case command.action == "dump" && len(args) == 1:
+	case command.action == "get" && len(args) == 2:
+		command.name = args[1]
+	case command.action == "set" && len(args) >= 2:
+		command.name = args[1]
+		command.value = strings.Join(args[2:], " ")
+	default:
+		return envCommand{}, usage
+	}
+	if command.name != "" && !envNamePattern.MatchString(command.name) {
+		return envCommand{}, errors.Errorf("invalid U-Boot variable name %q", command.name)
+	}
+	return command, nil
+}
+
+// run executes the command in the U-Boot shell and returns the message to show
+func (c envCommand) run(r *recipeRun) (string, error) {
+	env, err := r.readEnv()
+	if err != nil {
+		return "", err
+	}
+	switch c.action {
+	case "dump":
+		if err := ioutil.WriteFile(envDumpFileName, []byte(env.String()), 0644); err != nil {
+			return "", errors.Wrap(err, "Write environment dump")
+		}
+		return fmt.Sprintf("%d variables saved to %s", len(env), envDumpFileName), nil
+	case "get":
+		value, ok := env[c.name]
+		if !ok {
+			return "", errors.Errorf("%s is not set", c.name)
+		}
+		return c.name + "=" + value, nil
+	}
+	log.Infof("Setting %s=%q, was %q", c.name, c.value, env[c.name])
+	if err := r.setEnv(c.name, c.value); err != nil {
+		return "", err
+	}
+	if err := r.saveEnv(); err != nil {
+		return "", err
+	}
+	if c.value == "" {
+		return c.name + " deleted", nil
+	}
+	return c.name + "=" + c.value, nil
+}
+
+// loadShellRecipe loads the recipe of an env command, only its stages up to the U-Boot shell run so it is
+// checked without images, the flash guard still checks every command sent
+func loadShellRecipe(path string, ctx context) (*flashRecipe, error) {
+	recipe, err := loadRecipe(path)
+	if err != nil {
+		return nil, err
+	}
+	return recipe, recipe.validate(recipeVariables(ctx), recipeJobs)
+}
+
+// runEnvCommand reaches the U-Boot shell through the serial terminal sketch, runs the command and
+// boots Linux again. The terminal sketch is only flashed when it is not running and a sketch is given
+// to flash afterwards, so the MCU is never left without the sketch it had
+func runEnvCommand(ui *jobsui.UI, command envCommand, ctx context, usbDevices usbDatabase, selector *portSelector, terminalImage, sketchImage *mcuImage) {
+	ui.AddJob("findSerialPort", "Find serial port for upload")
+	ui.AddJob("uploadTerminalHex", "Flash MCU with serial terminal")
+	ui.AddJob("checkBridge", "Check MCU serial bridge")
+	ui.AddJob("envCommand", "Run U-Boot env "+command.action)
+	if sketchImage != nil {
+		ui.AddJob("uploadFirmware", "Flash MCU with sketch")
+	}
+
+	board := ctx.board
+	serialPortName, device, err := findSerialPortForFlashing(board, usbDevices, selector)
+	if err != nil {
+		ui.SetJobStateWithInfo("findSerialPort", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, "unable to find serial port for flashing")
+	}
+	ui.SetJobStateWithInfo("findSerialPort", jobsui.Done, serialPortName+" ("+device.Name+")")
+	report.SerialNumber = selector.serialNumber
+
+	port := serialPortName
+	ui.SetStatus("Checking the serial terminal sketch...")
+	if terminalSketchRunning(port) {
+		ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Skipped, "already running")
+	} else {
+		if sketchImage == nil {
+			err = errors.New("the serial terminal sketch is not running, flashing it would replace the sketch on the MCU: give 'sketch' to flash afterwards")
+			ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Error, err.Error())
+			log.Error(err)
+			waitForKeyAndExit(ui, err.Error())
+		}
+		ui.SetStatus(fmt.Sprintf("Flashing hex file: %s", terminalImage.name))
+		port, err = FlashHexFile(serialPortName, terminalImage, board.mcu, avrdudeStatusToUI(ui, terminalImage.name))
+		if err != nil {
+			ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Error, err.Error())
+			log.Error(err)
+			waitForKeyAndExit(ui, fmt.Sprintf("unable to flash %s", terminalImage.name))
+		}
+		port = selector.resolve(port)
+		ui.SetJobState("uploadTerminalHex", jobsui.Done)
+	}
+
+	exp, _, err, serport := serialSpawn(port, time.Duration(10)*time.Second, expect.CheckDuration(100*time.Millisecond), expect.Verbose(false), expect.VerboseWriter(os.Stdout))
+	if err != nil {
+		ui.SetJobStateWithInfo("checkBridge", jobsui.Error, "Unable to spawn serial port")
+		log.Errorf("Unable to spawn serial port: %s", err.Error())
+		waitForKeyAndExit(ui, "unable to spawn serial port")
+	}
+	ui.SetStatus("Checking MCU serial bridge...")
+	if err := CheckSerialBridge(exp); err != nil {
+		ui.SetJobStateWithInfo("checkBridge", jobsui.Error, err.Error())
+		log.Error(err)
+		exp.Close()
+		serport.Close()
+		waitForKeyAndExit(ui, err.Error())
+	}
+	ui.SetJobState("checkBridge", jobsui.Done)
+
+	message := ""
+	run, err := OpenUbootShell(exp, ctx, ui)
+	if err == nil {
+		message, err = command.run(run)
+		// boot Linux again whatever the outcome
+		exp.Send("reset\n")
+	}
+	exp.Close()
+	serport.Close()
+	if err != nil {
+		ui.SetJobStateWithInfo("envCommand", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	ui.SetJobStateWithInfo("envCommand", jobsui.Done, message)
+	log.Info(message)
+
+	if sketchImage == nil {
+		report.save()
+		ui.SetStatus(message + ". You may now close the window, or wait 10s")
+		time.Sleep(10 * time.Second)
+		return
+	}
+	serialPortName, _, err = findSerialPortForFlashing(board, usbDevices, selector)
+	if err == nil {
+		_, err = FlashHexFile(serialPortName, sketchImage, board.mcu, avrdudeStatusToUI(ui, sketchImage.name))
+	}
+	if err != nil {
+		ui.SetJobStateWithInfo("uploadFirmware", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, fmt.Sprintf("unable to flash %s", sketchImage.name))
+	}
+	ui.SetJobStateWithInfo("uploadFirmware", jobsui.Done, sketchImage.name)
+	report.save()
+
+	ui.SetStatus(message + ". You may now close the window, or wait 10s")
+	time.Sleep(10 * time.Second)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	backupRootDir = "backups"
+	// mdChunkSize is the amount of flash dumped by each md.b command
+	mdChunkSize = 0x1000
+	// mdCheckLimit is the largest image checked through md.b hexdumps when U-Boot has no crc32,
+	// a few minutes over the serial console
+	mdCheckLimit = 0x80000
+)
+
+var (
+	mdLinePattern = regexp.MustCompile(`(?m)^([0-9a-fA-F]{8}):((?: [0-9a-fA-F]{2}){1,16})`)
+	crc32Pattern  = regexp.MustCompile(`==> ([0-9a-fA-F]{8})`)
+	macPattern    = regexp.MustCompile(`(?i)ethaddr=((?:[0-9a-f]{2}:){5}[0-9a-f]{2})`)
+)
+
+// backupReport lists the partitions saved before flashing
+type backupReport struct {
+	Dir   string        `json:"dir"`
+	MAC   string        `json:"mac,omitempty"`
+	Files []imageReport `json:"files"`
+}
+
+// parseBackupSelection returns the flash regions to back up: "none", "all" for the whole flash
+// or a comma separated list of partition names
+func parseBackupSelection(selection string, layout flashLayout) ([]flashRegion, error) {
+	guard := newFlashGuard(layout)
+	partitions := append(guard.writableRegions(), layout.protected...)
+	switch selection {
+	case "", "none":
+		return nil, nil
+	case "all":
+		return []flashRegion{{"flash", layout.bootloaderAddr, layout.size}}, nil
+	}
+	regions := []flashRegion{}
+	for _, name := range strings.Split(selection, ",") {
+		found := false
+		for _, partition := range partitions {
+			if strings.EqualFold(partition.name, strings.TrimSpace(name)) {
+				regions = append(regions, partition)
+				found = true
+			}
+		}
+		if !found {
+			names := []string{}
+			for _, partition := range partitions {
+				names = append(names, partition.name)
+			}
+			return nil, errors.Errorf("unknown partition %q, use all, none or some of %s", name, strings.Join(names, ", "))
+		}
+	}
+	return regions, nil
+}
+
+// backupFlash saves the selected regions with a SHA256SUMS file in the run backup directory
+func backupFlash(r *recipeRun) error {
+	dir, err := r.backupDir()
+	if err != nil {
+		return err
+	}
+	r.vars["backup_dir"] = dir
+
+	sums := ""
+	for _, region := range r.ctx.backupRegions {
+		content, err := r.readRegion(region)
+		if err != nil {
+			return errors.Wrapf(err, "Back up %s", region.name)
+		}
+		name := region.name + ".bin"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			return errors.Wrap(err, "Write backup")
+		}
+		sum := sha256.Sum256(content)
+		checksum := hex.EncodeToString(sum[:])
+		sums += checksum + "  " + name + "\n"
+		report.Backup.Files = append(report.Backup.Files, imageReport{Name: name, Size: int64(len(content)), Checksum: checksum})
+		log.Infof("Backed up %s to %s, sha256 %s", region, filepath.Join(dir, name), checksum)
+	}
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(sums), 0644), "Write backup checksums")
+}
+
+// backupDir creates the run backup directory, named after the board MAC address, on first use
+func (r *recipeRun) backupDir() (string, error) {
+	if report.Backup != nil {
+		return report.Backup.Dir, nil
+	}
+	mac := r.boardMAC()
+	tag := strings.Replace(mac, ":", "", -1)
+	if tag == "" {
+		tag = "unknown"
+	}
+	dir := filepath.Join(backupRootDir, tag, time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.Wrap(err, "Create backup directory")
+	}
+	report.Backup = &backupReport{Dir: dir, MAC: mac}
+	return dir, nil
+}
+
+// readRegion reads a flash region with tftpput when U-Boot has it and with md.b hexdumps otherwise,
+// the content is checked against the CRC32 on the board and kept for the rest of the run
+func (r *recipeRun) readRegion(region flashRegion) ([]byte, error) {
+	key := region.String()
+	if content, ok := r.saved[key]; ok {
+		return content, nil
+	}
+	dir, err := r.backupDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	err = errors.New("tftpput not available")
+	if r.uboot.has("tftpput") && r.vars["transport"] != "serial" {
+		content, err = r.uploadRegion(region, dir)
+		if err != nil {
+			log.Warnf("tftpput of %s failed: %s, falling back to md.b", region.name, err.Error())
+		}
+	}
+	if err != nil {
+		content, err = r.dumpRegion(region)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := r.checkRegionCrc(region, content); err != nil {
+		return nil, err
+	}
+	if r.saved == nil {
+		r.saved = map[string][]byte{}
+	}
+	r.saved[key] = content
+	return content, nil
+}
+
+// boardMAC returns the ethaddr variable or the MAC address stored in flash, empty if neither is valid
+func (r *recipeRun) boardMAC() string {
+	if r.art != nil && r.art.mac != "" {
+		return r.art.mac
+	}
+	if output, err := r.command("printenv ethaddr", 5*time.Second); err == nil {
+		if match := macPattern.FindStringSubmatch(output); match != nil {
+			return strings.ToLower(match[1])
+		}
+	}
+	data, err := r.readMemory(r.ctx.board.flash.macAddr, 6)
+	if err != nil || bytes.Equal(data, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) || data[0]&1 != 0 {
+		log.Warn("Unable to read the board MAC address")
+		return ""
+	}
+	return formatMAC(data)
+}
+
+func formatMAC(data []byte) string {
+	parts := []string{}
+	for _, b := range data {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
+
+// uploadRegion sends the region to the updater TFTP server and reads back the received file
+func (r *recipeRun) uploadRegion(region flashRegion, dir string) ([]byte, error) {
+	name := region.name + ".tftp"
+	path := filepath.Join(dir, name)
+	defer os.Remove(path)
+	setUploadDir(dir, r.vars["ipaddr"], name)
+	defer setUploadDir("", "")
+	r.ui.SetStatus(fmt.Sprintf("Backing up %s with tftpput...", region.name))
+	// about 100kB/s on a loaded network
+	timeout := time.Duration(region.size/100000+30) * time.Second
+	output, err := r.command(fmt.Sprintf("tftpput %s %s %s", hexAddr(region.addr), hexAddr(region.size), name), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(output, "Bytes transferred = "+strconv.FormatInt(region.size, 10)) {
+		return nil, errors.Errorf("unexpected tftpput output %q", strings.TrimSpace(output))
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) != region.size {
+		return nil, errors.Errorf("received %d bytes, expected %d", len(content), region.size)
+	}
+	return content, nil
+}
+
+// dumpRegion reads the region through md.b hexdumps, slow but it only needs the console
+func (r *recipeRun) dumpRegion(region flashRegion) ([]byte, error) {
+	content := make([]byte, 0, region.size)
+	for offset := int64(0); offset < region.size; offset += mdChunkSize {
+		size := region.size - offset
+		if size > mdChunkSize {
+			size = mdChunkSize
+		}
+		chunk, err := r.readMemory(region.addr+offset, size)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+		r.ui.SetStatus(fmt.Sprintf("Reading %s over serial, %d%%", region.name, (offset+size)*100/region.size))
+	}
+	return content, nil
+}
+
+// readMemory parses the md.b hexdump of the given range
+func (r *recipeRun) readMemory(addr, size int64) ([]byte, error) {
+	output, err := r.command(fmt.Sprintf("md.b %s %s", hexAddr(addr), hexAddr(size)), 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, size)
+	for _, line := range mdLinePattern.FindAllStringSubmatch(output, -1) {
+		lineAddr, _ := strconv.ParseInt(line[1], 16, 64)
+		if lineAddr != addr+int64(len(data)) {
+			return nil, errors.Errorf("md.b line at %s, expected %s", hexAddr(lineAddr), hexAddr(addr+int64(len(data))))
+		}
+		values, _ := hex.DecodeString(strings.Replace(line[2], " ", "", -1))
+		data = append(data, values...)
+	}
+	if int64(len(data)) != size {
+		return nil, errors.Errorf("md.b returned %d bytes at %s, expected %d", len(data), hexAddr(addr), size)
+	}
+	return data, nil
+}
+
+// regionCrc returns the CRC32 computed by U-Boot on the region, or on its md.b hexdump when U-Boot has no crc32
+func (r *recipeRun) regionCrc(region flashRegion) (string, error) {
+	if r.uboot != nil && !r.uboot.has("crc32") {
+		content, err := r.dumpRegion(region)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)), nil
+	}
+	output, err := r.command(fmt.Sprintf("crc32 %s %s", hexAddr(region.addr), hexAddr(region.size)), 30*time.Second)
+	if err != nil {
+		return "", err
+	}
+	match := crc32Pattern.FindStringSubmatch(output)
+	if match == nil {
+		return "", errors.Errorf("unexpected crc32 output %q", strings.TrimSpace(output))
+	}
+	return strings.ToLower(match[1]), nil
+}
+
+// dumpImageCrc sets the variable to the CRC32 of the md.b hexdump of the stage image, in RAM or in its partition,
+// for bootloaders without crc32, images too big to be read back in reasonable time are an error
+func (r *recipeRun) dumpImageCrc(variable string, inFlash bool) error {
+	if r.stage == nil || r.stage.Image == "" {
+		return errors.New("needs a stage image")
+	}
+	name := r.vars[r.stage.Image+".name"]
+	size := imageEnv(*r.stage, r.ctx)["filesize"]
+	if size > mdCheckLimit {
+		return errors.Errorf("U-Boot has no crc32 and %s is too big to be read back over the console, it cannot be verified", name)
+	}
+	addr := r.ctx.board.flash.loadAddr
+	if inFlash {
+		addr, _ = strconv.ParseInt(strings.TrimPrefix(r.vars[r.stage.Image+".addr"], "0x"), 16, 64)
+	}
+	content, err := r.dumpRegion(flashRegion{name, addr, size})
+	if err != nil {
+		return err
+	}
+	r.vars[variable] = fmt.Sprintf("%08x", crc32.ChecksumIEEE(content))
+	log.Infof("CRC32 of %s at %s from md.b: %s", name, hexAddr(addr), r.vars[variable])
+	return nil
+}
+
+// checkRegionCrc compares the CRC32 computed by U-Boot on the region with the one of the saved content
+func (r *recipeRun) checkRegionCrc(region flashRegion, content []byte) error {
+	board, err := r.regionCrc(region)
+	if err != nil {
+		return err
+	}
+	local := fmt.Sprintf("%08x", crc32.ChecksumIEEE(content))
+	if board != local {
+		return errors.Errorf("CRC32 %s on the board, %s in the backup", board, local)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// flashRegion is a named range of the MPU flash
+type flashRegion struct {
+	name string
+	addr int64
+	size int64
+}
+
+func (r flashRegion) end() int64 {
+	return r.addr + r.size
+}
+
+func (r flashRegion) String() string {
+	return r.name + " " + hexAddr(r.addr) + "-" + hexAddr(r.end())
+}
+
+// flashGuard checks the U-Boot erase and copy commands against the board flash layout,
+// every flash write must stay inside a single writable partition
+type flashGuard struct {
+	layout flashLayout
+	// size is the detected flash size, the layout size until the flash is detected
+	size int64
+	// unlocked protected regions are writable, only while their backup is restored
+	unlocked map[string]bool
+}
+
+var (
+	flashSizePatterns = []*regexp.Regexp{
+		// flinfo, sector sizes are given in kB
+		regexp.MustCompile(`(?i)\bsize:\s*([0-9]+)\s*(M)i?B`),
+		// boot banner
+		regexp.MustCompile(`(?m)^\s*Flash:\s*([0-9]+)\s*(M)i?B`),
+	}
+	mtdpartsPattern = regexp.MustCompile(`mtdparts=[^:\s]+:(\S+)`)
+	mtdpartPattern  = regexp.MustCompile(`^([0-9]+)([kKmM]?)(?:@(0x[0-9a-fA-F]+|[0-9]+))?(\([^)]*\))?(ro)?$`)
+)
+
+func newFlashGuard(layout flashLayout) *flashGuard {
+	return &flashGuard{layout: layout, size: layout.size, unlocked: map[string]bool{}}
+}
+
+// detectFlashSize reads the flash size from the flinfo output, the boot banner or the mtdparts variable,
+// it returns 0 if none of them is found
+func detectFlashSize(output string) (int64, string) {
+	for _, pattern := range flashSizePatterns {
+		if match := pattern.FindStringSubmatch(output); match != nil {
+			size, _ := strconv.ParseInt(match[1], 10, 64)
+			return size * unitSize(match[2]), strings.TrimSpace(match[0])
+		}
+	}
+	if match := mtdpartsPattern.FindStringSubmatch(output); match != nil {
+		// partitions follow each other unless given an @offset, the flash ends with the last one
+		offset, total := int64(0), int64(0)
+		for _, part := range strings.Split(match[1], ",") {
+			fields := mtdpartPattern.FindStringSubmatch(part)
+			if fields == nil {
+				// "-" takes the rest of the flash, the total is unknown
+				return 0, ""
+			}
+			size, _ := strconv.ParseInt(fields[1], 10, 64)
+			if fields[3] != "" {
+				offset, _ = strconv.ParseInt(fields[3], 0, 64)
+			}
+			offset += size * unitSize(fields[2])
+			if offset > total {
+				total = offset
+			}
+		}
+		return total, match[0]
+	}
+	return 0, ""
+}
+
+func unitSize(unit string) int64 {
+	switch strings.ToLower(unit) {
+	case "k":
+		return 1 << 10
+	case "m":
+		return 1 << 20
+	}
+	return 1
+}
+
+// setDetectedSize refuses flash chips smaller than the board layout
+func (g *flashGuard) setDetectedSize(size int64, source string) error {
+	if size == 0 {
+		log.Warnf("Unable to detect the flash size, assuming %s", hexAddr(g.layout.size))
+		return nil
+	}
+	log.Infof("Detected flash size %s from %q", hexAddr(size), source)
+	if size < g.layout.size {
+		return errors.Errorf("flash is %s, the board layout needs %s", hexAddr(size), hexAddr(g.layout.size))
+	}
+	g.size = size
+	return nil
+}
+
+// writableRegions are the partitions the recipe may erase or copy to
+func (g *flashGuard) writableRegions() []flashRegion {
+	return []flashRegion{
+		{"u-boot", g.layout.bootloaderAddr, g.layout.bootloaderSize},
+		{"u-boot-env", g.layout.envAddr, g.layout.envSize},
+		{"firmware", g.layout.firmwareAddr, g.layout.firmwareSize},
+	}
+}
+
+// checkCommand refuses erase and copy commands writing outside a writable partition.
+// env holds the U-Boot variables the command may use, e.g. filesize, other commands are accepted.
+func (g *flashGuard) checkCommand(command string, env map[string]int64) error {
+	write, ok, err := parseWriteCommand(command, env)
+	if err != nil || !ok {
+		return err
+	}
+	return errors.Wrapf(g.checkWrite(write.addr, write.size), "refusing %q", command)
+}
+
+// parseWriteCommand returns the range written by an erase or copy command, ok is false for other commands
+func parseWriteCommand(command string, env map[string]int64) (write flashRegion, ok bool, err error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return write, false, nil
+	}
+	var addr, size int64
+	switch {
+	case fields[0] == "erase":
+		if len(fields) != 3 {
+			return write, true, errors.Errorf("refusing %q, only erase start end and erase start +size are allowed", command)
+		}
+		if addr, err = ubootNumber(fields[1], env); err != nil {
+			return write, true, errors.Wrapf(err, "refusing %q", command)
+		}
+		if strings.HasPrefix(fields[2], "+") {
+			size, err = ubootNumber(strings.TrimPrefix(fields[2], "+"), env)
+		} else {
+			var end int64
+			end, err = ubootNumber(fields[2], env)
+			size = end - addr + 1
+		}
+	case fields[0] == "cp" || strings.HasPrefix(fields[0], "cp."):
+		if len(fields) != 4 {
+			return write, true, errors.Errorf("refusing %q, expected cp.[bwl] source target count", command)
+		}
+		if addr, err = ubootNumber(fields[2], env); err != nil {
+			return write, true, errors.Wrapf(err, "refusing %q", command)
+		}
+		size, err = ubootNumber(fields[3], env)
+		switch fields[0] {
+		case "cp.w":
+			size *= 2
+		case "cp", "cp.l":
+			size *= 4
+		}
+	default:
+		return write, false, nil
+	}
+	if err != nil {
+		return write, true, errors.Wrapf(err, "refusing %q", command)
+	}
+	return flashRegion{fields[0], addr, size}, true, nil
+}
+
+// regionOf names the partition holding the write, "RAM" outside the flash
+func (g *flashGuard) regionOf(write flashRegion) string {
+	flash := flashRegion{"flash", g.layout.bootloaderAddr, g.size}
+	if write.end() <= flash.addr || write.addr >= flash.end() {
+		return "RAM"
+	}
+	for _, region := range append(g.writableRegions(), g.layout.protected...) {
+		if write.addr >= region.addr && write.end() <= region.end() {
+			return region.name
+		}
+	}
+	return "flash"
+}
+
+// checkWrite accepts writes outside the flash, e.g. to RAM, and writes inside a single writable partition
+func (g *flashGuard) checkWrite(addr, size int64) error {
+	if size <= 0 {
+		return errors.Errorf("empty range at %s", hexAddr(addr))
+	}
+	flash := flashRegion{"flash", g.layout.bootloaderAddr, g.size}
+	write := flashRegion{"write", addr, size}
+	if write.end() <= flash.addr || write.addr >= flash.end() {
+		return nil
+	}
+	if write.end() > flash.end() {
+		return errors.Errorf("%s crosses the end of the flash at %s", write, hexAddr(flash.end()))
+	}
+	writable := g.writableRegions()
+	for _, region := range g.layout.protected {
+		if g.unlocked[region.name] {
+			writable = append(writable, region)
+		} else if write.addr < region.end() && write.end() > region.addr {
+			return errors.Errorf("%s crosses into protected %s", write, region)
+		}
+	}
+	for _, region := range writable {
+		if write.addr >= region.addr && write.end() <= region.end() {
+			return nil
+		}
+	}
+	return errors.Errorf("%s crosses a partition boundary", write)
+}
+
+// protectedRegion returns the protected region with the given name
+func (g *flashGuard) protectedRegion(name string) (flashRegion, bool) {
+	for _, region := range g.layout.protected {
+		if region.name == name {
+			return region, true
+		}
+	}
+	return flashRegion{}, false
+}
+
+// ubootNumber parses a hexadecimal U-Boot argument, with or without 0x, or a known $variable
+func ubootNumber(value string, env map[string]int64) (int64, error) {
+	if strings.HasPrefix(value, "$") {
+		name := strings.Trim(strings.TrimPrefix(value, "$"), "{}")
+		number, ok := env[name]
+		if !ok {
+			return 0, errors.Errorf("unknown value of %s", value)
+		}
+		return number, nil
+	}
+	number, err := strconv.ParseInt(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid number %s", value)
+	}
+	return number, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseWriteCommand(t *testing.T) {
+	env := map[string]int64{"fileaddr": 0x80060000, "filesize": 0x100}
+	tests := []struct {
+		command string
+		write   flashRegion
+		ok      bool
+		err     string
+	}{
+		{"erase 0x9f050000 +0xfa0000", flashRegion{"erase", 0x9f050000, 0xfa0000}, true, ""},
+		{"erase 9f050000 9fffffff", flashRegion{"erase", 0x9f050000, 0xfb0000}, true, ""},
+		{"cp.b $fileaddr 0x9f000000 $filesize", flashRegion{"cp.b", 0x9f000000, 0x100}, true, ""},
+		{"cp.b $fileaddr 0x9f000000 ${filesize}", flashRegion{"cp.b", 0x9f000000, 0x100}, true, ""},
+		{"cp.w 80060000 9f000000 10", flashRegion{"cp.w", 0x9f000000, 0x20}, true, ""},
+		{"cp 80060000 9f000000 10", flashRegion{"cp", 0x9f000000, 0x40}, true, ""},
+		{"printenv ipaddr", flashRegion{}, false, ""},
+		{"", flashRegion{}, false, ""},
+		{"erase 0x9f000000", flashRegion{}, true, "only erase start end"},
+		{"erase all", flashRegion{}, true, "only erase start end"},
+		{"cp.b $fileaddr 0x9f000000", flashRegion{}, true, "expected cp.[bwl]"},
+		{"cp.b $fileaddr 0x9f000000 $size", flashRegion{}, true, "unknown value of $size"},
+		{"erase 0x9f000000 +zz", flashRegion{}, true, "invalid number zz"},
+	}
+	for _, test := range tests {
+		write, ok, err := parseWriteCommand(test.command, env)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected %q, got %v", test.command, test.err, err)
+			}
+			continue
+		}
+		if err != nil || ok != test.ok || write != test.write {
+			t.Errorf("%q: got %v %v %v, expected %v %v", test.command, write, ok, err, test.write, test.ok)
+		}
+	}
+}
+
+func TestCheckWrite(t *testing.T) {
+	layout := ar9331Flash
+	firmwareEnd := layout.firmwareAddr + layout.firmwareSize
+	tests := []struct {
+		name     string
+		addr     int64
+		size     int64
+		unlocked bool
+		detected int64
+		err      string
+	}{
+		{"RAM", layout.loadAddr, 0x10000, false, 0, ""},
+		{"before the flash", layout.bootloaderAddr - 0x10000, 0x10000, false, 0, ""},
+		{"after the flash", layout.bootloaderAddr + layout.size, 0x10000, false, 0, ""},
+		{"bootloader", layout.bootloaderAddr, layout.bootloaderSize, false, 0, ""},
+		{"firmware", layout.firmwareAddr, layout.firmwareSize, false, 0, ""},
+		{"empty", layout.firmwareAddr, 0, false, 0, "empty range"},
+		{"bootloader into env", layout.envAddr - 0x100, 0x200, false, 0, "partition boundary"},
+		{"firmware into ART", layout.firmwareAddr, layout.firmwareSize + 1, false, 0, "protected art"},
+		{"last byte of ART", firmwareEnd + 0xffff, 1, false, 0, "protected art"},
+		{"ART unlocked", firmwareEnd, 0x10000, true, 0, ""},
+		{"firmware into unlocked ART", firmwareEnd - 0x100, 0x200, true, 0, "partition boundary"},
+		{"end of the flash", firmwareEnd + 0xfff0, 0x20, true, 0, "crosses the end of the flash"},
+		{"past the layout", layout.bootloaderAddr + layout.size, 0x10000, false, 2 * layout.size, "partition boundary"},
+	}
+	for _, test := range tests {
+		guard := newFlashGuard(layout)
+		if test.unlocked {
+			guard.unlocked["art"] = true
+		}
+		if test.detected != 0 {
+			if err := guard.setDetectedSize(test.detected, "test"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := guard.checkWrite(test.addr, test.size)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+	}
+}
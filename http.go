@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"path"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// httpHandler serves the tftp directory, and the served files, to wget on the board Linux
+func httpHandler(w http.ResponseWriter, req *http.Request) {
+	name := path.Base(req.URL.Path)
+	filePath := tftpFilePath(name)
+	servedFiles.Lock()
+	if served, ok := servedFiles.paths[name]; ok {
+		filePath = served
+	}
+	servedFiles.Unlock()
+	log.Infof("HTTP request for %s from %s", name, req.RemoteAddr)
+	http.ServeFile(w, req, filePath)
+}
+
+// ServeHTTP starts an HTTP server on a free port for the Linux sysupgrade download, it returns the port
+func ServeHTTP() (int, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, errors.Wrap(err, "Can't start http server")
+	}
+	go http.Serve(listener, http.HandlerFunc(httpHandler))
+	port := listener.Addr().(*net.TCPAddr).Port
+	log.Infof("Started http server at port %d", port)
+	return port, nil
+}
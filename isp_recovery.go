@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	jobsui "github.com/mic90/go-jobs-ui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ispProgrammer describes an external programmer supported by the recovery mode
+type ispProgrammer struct {
+	name string
+	// protocol is the avrdude programmer id
+	protocol string
+	// needsPort is true for programmers attached through a serial port
+	needsPort bool
+	baudRate  int
+}
+
+var ispProgrammers = []ispProgrammer{
+	{name: "usbasp", protocol: "usbasp"},
+	{name: "avrisp", protocol: "avrisp", needsPort: true, baudRate: 19200},
+	{name: "arduinoisp", protocol: "stk500v1", needsPort: true, baudRate: 19200},
+	{name: "stk500v2", protocol: "stk500v2", needsPort: true},
+}
+
+// findIspProgrammer returns the supported programmer with the given name
+func findIspProgrammer(name string) (*ispProgrammer, error) {
+	names := []string{}
+	for i := range ispProgrammers {
+		if strings.EqualFold(ispProgrammers[i].name, name) {
+			return &ispProgrammers[i], nil
+		}
+		names = append(names, ispProgrammers[i].name)
+	}
+	return nil, errors.Errorf("unknown ISP programmer %q, supported programmers: %s", name, strings.Join(names, ", "))
+}
+
+var fuseValue = regexp.MustCompile(`^0x[0-9a-fA-F]{1,2}$`)
+
+// ispRecovery burns the MCU bootloader and fuses through an external ISP programmer
+type ispRecovery struct {
+	ui         *jobsui.UI
+	board      *boardProfile
+	programmer *ispProgrammer
+	port       string
+	binDir     string
+}
+
+// RecoverMcuBootloader checks the MCU signature and fuses through the [programmer], asks [confirm] with the exact
+// values that are going to be written and then burns the board Caterina bootloader and fuses
+func RecoverMcuBootloader(ui *jobsui.UI, board *boardProfile, programmer *ispProgrammer, port string, confirm func(question string) bool) error {
+	if programmer.needsPort && port == "" {
+		return errors.Errorf("ISP programmer %s needs a serial port", programmer.name)
+	}
+	if !programmer.needsPort {
+		port = "usb"
+	}
+
+	execDir, _ := os.Executable()
+	execDir = filepath.Dir(execDir)
+	r := &ispRecovery{ui: ui, board: board, programmer: programmer, port: port, binDir: filepath.Join(execDir, "avr")}
+
+	// the Caterina images are fetched into avr/ when the package is built, check them before touching the MCU
+	bootloaderHex := filepath.Join(r.binDir, board.images.mcuBootloaderHex)
+	if err := checkBootloaderHex(bootloaderHex, board.mcu); err != nil {
+		return err
+	}
+
+	ui.SetStatus("Reading MCU signature...")
+	signature, err := r.readSignature()
+	if err != nil {
+		ui.SetJobStateWithInfo("ispSignature", jobsui.Error, err.Error())
+		return err
+	}
+	if !strings.EqualFold(signature, board.mcu.signature) {
+		err = errors.Errorf("MCU signature is %s, %s expects %s (%s)", signature, board.name, board.mcu.signature, board.mcu.part)
+		ui.SetJobStateWithInfo("ispSignature", jobsui.Error, err.Error())
+		return err
+	}
+	ui.SetJobStateWithInfo("ispSignature", jobsui.Done, signature)
+
+	ui.SetStatus("Reading MCU fuses...")
+	current, err := r.readFuses()
+	if err != nil {
+		ui.SetJobStateWithInfo("ispFuses", jobsui.Error, err.Error())
+		return err
+	}
+	ui.SetJobStateWithInfo("ispFuses", jobsui.Done, formatFuses(current))
+
+	target := board.mcu.fuses
+	question := fmt.Sprintf("Burn %s and fuses %s (now %s)? Type y and press Enter to continue",
+		board.images.mcuBootloaderHex, formatFuses(target), formatFuses(current))
+	if !confirm(question) {
+		ui.SetJobStateWithInfo("ispBurn", jobsui.Skipped, "cancelled by user")
+		ui.SetJobState("ispVerify", jobsui.Skipped)
+		return errors.New("bootloader recovery cancelled")
+	}
+
+	ui.SetStatus("Writing MCU fuses...")
+	// same sequence as the Arduino IDE "Burn Bootloader": unlock, erase and set fuses, then flash and lock
+	_, err = r.avrdude([]string{"-e",
+		"-Ulock:w:" + hexByte(target.unlockBits) + ":m",
+		"-Uefuse:w:" + hexByte(target.extended) + ":m",
+		"-Uhfuse:w:" + hexByte(target.high) + ":m",
+		"-Ulfuse:w:" + hexByte(target.low) + ":m"})
+	if err == nil {
+		_, err = r.avrdude([]string{
+			"-Uflash:w:" + bootloaderHex + ":i",
+			"-Ulock:w:" + hexByte(target.lockBits) + ":m"})
+	}
+	if err != nil {
+		ui.SetJobStateWithInfo("ispBurn", jobsui.Error, err.Error())
+		return err
+	}
+	ui.SetJobStateWithInfo("ispBurn", jobsui.Done, board.images.mcuBootloaderHex)
+
+	ui.SetStatus("Verifying MCU fuses...")
+	written, err := r.readFuses()
+	if err == nil && !sameFuses(written, target) {
+		err = errors.Errorf("fuses read back as %s, expected %s", formatFuses(written), formatFuses(target))
+	}
+	if err != nil {
+		ui.SetJobStateWithInfo("ispVerify", jobsui.Error, err.Error())
+		return err
+	}
+	ui.SetJobStateWithInfo("ispVerify", jobsui.Done, formatFuses(written))
+	log.Infof("Bootloader recovered, fuses %s", formatFuses(written))
+	return nil
+}
+
+// args returns the avrdude arguments selecting the MCU and the ISP programmer
+func (r *ispRecovery) args() []string {
+	args := []string{"-C" + r.binDir + "/etc/avrdude.conf", "-v", "-p" + r.board.mcu.part, "-c" + r.programmer.protocol, "-P" + r.port}
+	if r.programmer.baudRate != 0 {
+		args = append(args, "-b"+strconv.Itoa(r.programmer.baudRate))
+	}
+	return args
+}
+
+// avrdude runs avrdude through the ISP programmer with the given operations
+func (r *ispRecovery) avrdude(operations []string) ([]string, error) {
+	return execAvrdude(avrdudeBinary(r.binDir), append(r.args(), operations...), func(status avrdudeStatus) {
+		if status.operation != "" {
+			r.ui.SetStatus(fmt.Sprintf("ISP %s %d%%", strings.ToLower(status.operation), status.percent))
+		}
+	})
+}
+
+// readSignature connects to the MCU without any memory operation, avrdude always reads the signature.
+// -F keeps avrdude going on a mismatch so the comparison is done here with a clearer message.
+func (r *ispRecovery) readSignature() (string, error) {
+	signature := ""
+	_, err := execAvrdude(avrdudeBinary(r.binDir), append(r.args(), "-F"), func(status avrdudeStatus) {
+		signature = status.signature
+	})
+	if err != nil {
+		return "", err
+	}
+	if signature == "" {
+		return "", errors.New("avrdude did not report the MCU signature")
+	}
+	return signature, nil
+}
+
+func (r *ispRecovery) readFuses() (mcuFuses, error) {
+	output, err := r.avrdude([]string{"-Ulfuse:r:-:h", "-Uhfuse:r:-:h", "-Uefuse:r:-:h"})
+	if err != nil {
+		return mcuFuses{}, err
+	}
+	values := []byte{}
+	for _, line := range output {
+		line = strings.TrimSpace(line)
+		if fuseValue.MatchString(line) {
+			value, _ := strconv.ParseUint(line[2:], 16, 8)
+			values = append(values, byte(value))
+		}
+	}
+	if len(values) != 3 {
+		return mcuFuses{}, errors.Errorf("unable to read fuses, got %v", output)
+	}
+	return mcuFuses{low: values[0], high: values[1], extended: values[2], extendedMask: r.board.mcu.fuses.extendedMask}, nil
+}
+
+func sameFuses(a, b mcuFuses) bool {
+	return a.low == b.low && a.high == b.high && a.extended&b.extendedMask == b.extended&b.extendedMask
+}
+
+func formatFuses(f mcuFuses) string {
+	return fmt.Sprintf("lfuse=%s hfuse=%s efuse=%s", hexByte(f.low), hexByte(f.high), hexByte(f.extended))
+}
+
+func hexByte(b byte) string {
+	return fmt.Sprintf("0x%02x", b)
+}
+
+// caterinaSize is the boot section the Caterina bootloader lives in, right after the sketch area
+const caterinaSize = 0x1000
+
+// checkBootloaderHex reads the bootloader image and checks that it only fills the boot section
+func checkBootloaderHex(path string, mcu mcuProfile) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return errors.Errorf("MCU bootloader image %s is missing from the avr directory of the package", filepath.Base(path))
+	}
+	if err != nil {
+		return errors.Wrap(err, "MCU bootloader image")
+	}
+	program, err := parseIntelHex(content, mcu.maxSketchSize+caterinaSize)
+	if err != nil {
+		return errors.Wrap(err, filepath.Base(path))
+	}
+	if len(program) <= mcu.maxSketchSize {
+		return errors.Errorf("%s has no data in the %s boot section at %#x", filepath.Base(path), mcu.part, mcu.maxSketchSize)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	expect "github.com/facchinm/goexpect"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kermit is used rather than YMODEM because its packets can be encoded around the escape sequences of the
+// serial terminal sketch: "~" followed by a speed key or another "~" is never seen by U-Boot.
+const (
+	kermitSOH   = 0x01
+	kermitQuote = '#'
+	// kermitMaxData keeps the packet length below 94, whose length character would be "~"
+	kermitMaxData = 80
+	kermitRetries = 5
+	kermitTimeout = 5 * time.Second
+)
+
+var (
+	loadbReady = regexp.MustCompile(`Ready for binary \(kermit\) download`)
+	loadbTotal = regexp.MustCompile(`## Total Size\s*=\s*0x([0-9a-fA-F]+)`)
+	kermitAck  = regexp.MustCompile(`\x01[\x20-\x7e]([\x20-\x7e])([YNE])`)
+	// terminalEscapeKeys follow "~" in the commands of the serial terminal sketch
+	terminalEscapeKeys = "01234~"
+)
+
+// kermitSender sends a file to the U-Boot loadb command over the console expecter
+type kermitSender struct {
+	exp expect.Expecter
+	// progress is called after every acknowledged data packet
+	progress func(sent, total int)
+}
+
+func tochar(x int) byte {
+	return byte(x + 32)
+}
+
+// kermitPacket frames the data with length, sequence number, type and type 1 block check
+func kermitPacket(seq int, kind byte, data []byte) []byte {
+	packet := append([]byte{tochar(len(data) + 3), tochar(seq % 64), kind}, data...)
+	sum := 0
+	for _, b := range packet {
+		sum += int(b)
+	}
+	check := tochar((sum + (sum&192)>>6) & 63)
+	return append(append([]byte{kermitSOH}, packet...), check, '\r')
+}
+
+// kermitEncode encodes as many bytes of content as fit in a data packet, it returns the encoded data
+// and the number of bytes consumed. Control characters are prefixed, and so is any character that would
+// follow a "~" and form a terminal sketch command, which U-Boot decodes to the character itself.
+func kermitEncode(content []byte, seq int) ([]byte, int, error) {
+	encoded := []byte{}
+	// units holds the encoded length after each consumed byte
+	units := []int{}
+	for _, b := range content {
+		unit := []byte{b}
+		switch {
+		case b == kermitQuote:
+			unit = []byte{kermitQuote, b}
+		case b&0x7f < 0x20 || b&0x7f == 0x7f:
+			unit = []byte{kermitQuote, b ^ 0x40}
+		}
+		if len(encoded) > 0 && encoded[len(encoded)-1] == '~' && strings.IndexByte(terminalEscapeKeys, unit[0]) >= 0 {
+			unit = append([]byte{kermitQuote}, unit...)
+		}
+		if len(encoded)+len(unit) > kermitMaxData {
+			break
+		}
+		encoded = append(encoded, unit...)
+		units = append(units, len(encoded))
+	}
+
+	// a trailing "~" is followed by the block check, which must not be a sketch command key either
+	for len(units) > 0 {
+		encoded = encoded[:units[len(units)-1]]
+		packet := kermitPacket(seq, 'D', encoded)
+		check := packet[len(packet)-2]
+		if encoded[len(encoded)-1] != '~' || strings.IndexByte(terminalEscapeKeys, check) < 0 {
+			return encoded, len(units), nil
+		}
+		units = units[:len(units)-1]
+	}
+	return nil, 0, errors.New("data cannot be encoded through the serial terminal sketch")
+}
+
+// send transfers the file, loadb must already be waiting for it
+func (k *kermitSender) send(name string, content []byte) error {
+	// MAXL, TIME, NPAD, PADC, EOL, QCTL, QBIN (none), CHKT (1), REPT (none)
+	initData := []byte{tochar(kermitMaxData + 3), tochar(5), tochar(0), '@', tochar('\r'), kermitQuote, 'N', '1', ' '}
+	seq := 0
+	if err := k.sendPacket(kermitPacket(seq, 'S', initData), seq); err != nil {
+		return errors.Wrap(err, "Kermit send init")
+	}
+	seq++
+	if err := k.sendPacket(kermitPacket(seq, 'F', []byte(name)), seq); err != nil {
+		return errors.Wrap(err, "Kermit file header")
+	}
+	for sent := 0; sent < len(content); {
+		seq++
+		data, consumed, err := kermitEncode(content[sent:], seq)
+		if err != nil {
+			return errors.Wrapf(err, "at offset %d", sent)
+		}
+		if err := k.sendPacket(kermitPacket(seq, 'D', data), seq); err != nil {
+			return errors.Wrapf(err, "Kermit data at offset %d", sent)
+		}
+		sent += consumed
+		if k.progress != nil {
+			k.progress(sent, len(content))
+		}
+	}
+	seq++
+	if err := k.sendPacket(kermitPacket(seq, 'Z', nil), seq); err != nil {
+		return errors.Wrap(err, "Kermit end of file")
+	}
+	seq++
+	return errors.Wrap(k.sendPacket(kermitPacket(seq, 'B', nil), seq), "Kermit end of transfer")
+}
+
+// sendPacket sends the packet until it is acknowledged
+func (k *kermitSender) sendPacket(packet []byte, seq int) error {
+	for attempt := 0; attempt <= kermitRetries; attempt++ {
+		if err := k.exp.Send(string(packet)); err != nil {
+			return err
+		}
+		_, match, err := k.exp.Expect(kermitAck, kermitTimeout)
+		switch {
+		case err != nil:
+			log.Debugf("Kermit packet %d not acknowledged: %s", seq, err.Error())
+		case match[2] == "E":
+			return errors.New("transfer cancelled by U-Boot")
+		case match[2] == "Y" && match[1][0] == tochar(seq%64):
+			return nil
+		}
+	}
+	return errors.Errorf("packet %d not acknowledged after %d attempts", seq, kermitRetries+1)
+}
+
+// loadSerial sends the content to the board RAM at the load address with loadb, like tftp it sets
+// fileaddr and filesize
+func (r *recipeRun) loadSerial(name string, content []byte) error {
+	if r.uboot != nil && !r.uboot.has("loadb") {
+		return errors.Errorf("U-Boot %s has no loadb, the image cannot be sent over serial", r.uboot.Name)
+	}
+	loadAddr := hexAddr(r.ctx.board.flash.loadAddr)
+	if err := r.exp.Send("loadb " + loadAddr + "\n"); err != nil {
+		return err
+	}
+	if _, _, err := r.exp.Expect(loadbReady, 10*time.Second); err != nil {
+		return errors.Wrap(err, "loadb did not start")
+	}
+
+	start := time.Now()
+	percent := -1
+	sender := &kermitSender{exp: r.exp, progress: func(sent, total int) {
+		if sent*100/total != percent {
+			percent = sent * 100 / total
+			elapsed := time.Since(start)
+			remaining := time.Duration(float64(elapsed) * float64(total-sent) / float64(sent))
+			r.ui.SetStatus(fmt.Sprintf("Sending %s over serial, %d%%, %s left", name, percent, remaining.Round(time.Second)))
+		}
+	}}
+	if err := sender.send(name, content); err != nil {
+		return err
+	}
+	_, match, err := r.exp.Expect(loadbTotal, 10*time.Second)
+	if err != nil {
+		return errors.Wrap(err, "loadb did not end")
+	}
+	if size, _ := strconv.ParseInt(match[1], 16, 64); size != int64(len(content)) {
+		return errors.Errorf("loadb received %d bytes, %d sent", size, len(content))
+	}
+	log.Infof("Sent %s over serial: %d bytes in %s", name, len(content), time.Since(start).Round(time.Second))
+
+	// wait for the prompt printed after the transfer before the next command
+	if _, err := r.command("", 5*time.Second); err != nil {
+		return err
+	}
+	if _, err := r.command("setenv fileaddr "+loadAddr, 5*time.Second); err != nil {
+		return err
+	}
+	_, err = r.command("setenv filesize "+strconv.FormatInt(int64(len(content)), 16), 5*time.Second)
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	jobsui "github.com/mic90/go-jobs-ui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// linuxUploadChunk is the number of bytes written by each printf during a serial upload
+	linuxUploadChunk = 256
+	linuxUploadDir   = "/tmp"
+)
+
+var (
+	linuxPromptPattern = regexp.MustCompile(`root@[^\s:]+:[^\r\n]*# `)
+	mtdLinePattern     = regexp.MustCompile(`(?m)^(mtd[0-9]+): [0-9a-fA-F]+ [0-9a-fA-F]+ "([^"]+)"`)
+	md5Pattern         = regexp.MustCompile(`\b([0-9a-f]{32})\b`)
+)
+
+// linuxCommand sends a command to the Linux shell and waits for the prompt
+func (r *recipeRun) linuxCommand(command string, timeout time.Duration) (string, error) {
+	if err := r.exp.Send(command + "\n"); err != nil {
+		return "", err
+	}
+	output, _, err := r.exp.Expect(linuxPromptPattern, timeout)
+	if err != nil {
+		return output, errors.Wrap(err, command)
+	}
+	return output, nil
+}
+
+// linuxBootloaderCurrent returns true if the U-Boot partition seen from Linux starts with the bootloader image
+func (r *recipeRun) linuxBootloaderCurrent() (bool, error) {
+	output, err := r.linuxCommand("cat /proc/mtd", 5*time.Second)
+	if err != nil {
+		return false, err
+	}
+	device := ""
+	for _, match := range mtdLinePattern.FindAllStringSubmatch(output, -1) {
+		if match[2] == "u-boot" {
+			device = "/dev/" + match[1]
+		}
+	}
+	if device == "" {
+		return false, errors.New("no u-boot partition in /proc/mtd")
+	}
+	image := r.ctx.bootloaderFirmware
+	output, err = r.linuxCommand(fmt.Sprintf("head -c %d %s | md5sum", image.size, device), 10*time.Second)
+	if err != nil {
+		return false, err
+	}
+	match := md5Pattern.FindStringSubmatch(output)
+	if match == nil {
+		return false, errors.Errorf("unexpected md5sum output %q", strings.TrimSpace(output))
+	}
+	log.Infof("Bootloader MD5 %s on the board, %s for %s", match[1], image.md5, image.name)
+	return match[1] == image.md5, nil
+}
+
+// chooseRecipe returns the Linux sysupgrade recipe when the board runs Linux and its bootloader
+// does not need flashing, so that U-Boot is left alone, and the U-Boot recipe otherwise
+func (r *recipeRun) chooseRecipe() (*flashRecipe, error) {
+	ctx := r.ctx
+	if ctx.mode == "uboot" || ctx.linuxRecipe == nil {
+		return ctx.recipe, nil
+	}
+	r.ui.SetStatus("Checking the board Linux shell...")
+	if _, err := r.linuxCommand("", 5*time.Second); err != nil {
+		if ctx.mode == "linux" {
+			return nil, errors.New("the board is not running Linux, the linux mode needs a root shell")
+		}
+		log.Infof("No Linux shell, flashing from U-Boot")
+		return ctx.recipe, nil
+	}
+
+	reason := "not requested"
+	if *ctx.flashBootloader {
+		current, err := r.linuxBootloaderCurrent()
+		switch {
+		case err != nil && ctx.mode == "auto":
+			log.Infof("Unable to check the bootloader from Linux: %s, flashing from U-Boot", err.Error())
+			return ctx.recipe, nil
+		case !current && ctx.mode == "auto":
+			log.Info("Bootloader is outdated, flashing from U-Boot")
+			return ctx.recipe, nil
+		case !current:
+			log.Warn("Bootloader is outdated or unknown, it is not flashed in linux mode")
+			reason = "outdated, not flashed in linux mode"
+		default:
+			reason = "already current"
+		}
+	}
+	log.Infof("Updating from Linux with sysupgrade, bootloader %s", reason)
+	report.Mode = "linux"
+	r.ui.SetJobStateWithInfo("backupFlash", jobsui.Skipped, "Linux sysupgrade")
+	r.ui.SetJobStateWithInfo("flashBootloader", jobsui.Skipped, reason)
+	return ctx.linuxRecipe, nil
+}
+
+// uploadLinux writes the stage image to the Linux temporary directory through the console, with printf
+// octal escapes so that no byte can form a serial terminal sketch command
+func uploadLinux(r *recipeRun) error {
+	if r.stage == nil || r.stage.Image == "" {
+		return errors.New("upload_linux needs a stage image")
+	}
+	name := r.vars[r.stage.Image+".name"]
+	content, err := ioutil.ReadFile(servedFilePath(name))
+	if err != nil {
+		return errors.Wrap(err, "Read firmware image")
+	}
+	path := linuxUploadDir + "/" + name
+	if _, err := r.linuxCommand("rm -f "+path, 5*time.Second); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for offset := 0; offset < len(content); offset += linuxUploadChunk {
+		end := offset + linuxUploadChunk
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := r.linuxCommand("printf '"+printfEscape(content[offset:end])+"' >> "+path, 10*time.Second); err != nil {
+			return errors.Wrapf(err, "at offset %d", offset)
+		}
+		if offset%(linuxUploadChunk*64) == 0 {
+			r.ui.SetStatus(fmt.Sprintf("Sending %s over serial, %d%%", name, end*100/len(content)))
+		}
+	}
+	log.Infof("Sent %s over serial: %d bytes in %s", name, len(content), time.Since(start).Round(time.Second))
+	return nil
+}
+
+// printfEscape keeps letters and digits and writes every other byte as an octal escape
+func printfEscape(data []byte) string {
+	escaped := strings.Builder{}
+	for _, b := range data {
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "\\%03o", b)
+		}
+	}
+	return escaped.String()
+}
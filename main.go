@@ -1,10 +1,15 @@
 package main
 
 import (
+	"crypto/md5"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	expect "github.com/facchinm/goexpect"
@@ -18,6 +23,12 @@ import (
 type firmwareFile struct {
 	name string
 	size int64
+	// crc32 is the IEEE checksum as printed by the U-Boot crc32 command
+	crc32 string
+	// version is read from the image metadata, empty if unknown
+	version string
+	// md5 is compared with md5sum on the board Linux
+	md5 string
 }
 
 type context struct {
@@ -26,13 +37,56 @@ type context struct {
 	ipAddr             string
 	bootloaderFirmware firmwareFile
 	sysupgradeFirmware firmwareFile
-	targetBoard        *string
+	board              *boardProfile
+	recipe             *flashRecipe
+	// backupRegions are saved from the flash before anything is erased
+	backupRegions []flashRegion
+	// restoreEnv are the U-Boot variables put back after the bootloader is flashed
+	restoreEnv []string
+	// transport is how the images reach the board: tftp, falling back to serial, or serial only
+	transport string
+	// httpPort serves the images to wget on the board Linux, 0 if the server is not running
+	httpPort int
+	// mode is auto, uboot or linux, linuxRecipe runs sysupgrade from the board Linux in auto and linux modes
+	mode        string
+	linuxRecipe *flashRecipe
+	// keepConfig preserves the Linux configuration across a Linux sysupgrade
+	keepConfig bool
+	// retries are the extra runs of the whole MPU flash after a failure
+	retries int
+	// state is the saved progress of the run, nil when nothing is flashed for real
+	state *runState
 }
 
-func getFileSize(path string) int64 {
-	file, _ := os.Open(path)
-	fi, _ := file.Stat()
-	return fi.Size()
+// loadFirmwareFile reads the image from the tftp directory to get its size and checksum
+func loadFirmwareFile(tftpDir, name string) (firmwareFile, []byte, error) {
+	content, err := ioutil.ReadFile(filepath.Join(tftpDir, name))
+	if err != nil {
+		return firmwareFile{}, nil, errors.Wrap(err, "Read firmware image")
+	}
+	return firmwareFile{name: name, size: int64(len(content)), crc32: fmt.Sprintf("%08x", crc32.ChecksumIEEE(content)), md5: fmt.Sprintf("%x", md5.Sum(content))}, content, nil
+}
+
+// loadSysupgradeFile reads the sysupgrade image and checks it is meant for the board
+func loadSysupgradeFile(tftpDir string, board *boardProfile) (firmwareFile, error) {
+	file, content, err := loadFirmwareFile(tftpDir, board.images.sysupgrade)
+	if err != nil {
+		return file, err
+	}
+	image, err := parseSysupgradeImage(content)
+	if err == nil {
+		err = checkSysupgradeImage(image, file.size, board)
+	}
+	if err != nil {
+		return file, errors.Wrapf(err, "Invalid sysupgrade image %s", file.name)
+	}
+	log.Infof("Sysupgrade kernel %q: %d bytes at %s, squashfs at offset %s", image.kernelName, image.kernelSize, hexAddr(image.kernelLoadAddr), hexAddr(image.rootfsOffset))
+	file.version = image.version
+	if file.version == "" {
+		log.Warnf("Sysupgrade image %s has no metadata, supported devices not checked", file.name)
+		file.version = image.kernelName
+	}
+	return file, nil
 }
 
 // setup logger
@@ -50,111 +104,449 @@ func init() {
 }
 
 func waitForKeyAndExit(ui *jobsui.UI, errorMessage string) {
+	report.Error = errorMessage
+	report.save()
 	ui.SetStatus(fmt.Sprintf("Press any key to exit, error: %s", errorMessage))
 	fmt.Scanln()
 	os.Exit(1)
 }
 
-func main() {
+// avrdudeStatusToUI shows avrdude progress for the given image in the UI status line
+func avrdudeStatusToUI(ui *jobsui.UI, imageName string) func(avrdudeStatus) {
+	return func(status avrdudeStatus) {
+		message := "Flashing hex file: " + imageName
+		// avrdude prints the signature after its first progress bar, keep it shown from then on
+		if status.signature != "" {
+			message += ", device signature " + status.signature
+		}
+		if status.operation != "" {
+			message += fmt.Sprintf(", %s %d%%", strings.ToLower(status.operation), status.percent)
+		}
+		ui.SetStatus(message)
+	}
+}
+
+// askUser shows the question in the UI status line and returns the line typed by the user
+func askUser(ui *jobsui.UI, question string) string {
+	ui.SetStatus(question)
+	answer := ""
+	fmt.Scanln(&answer)
+	return answer
+}
+
+// askConfirmation shows the question in the UI status line and returns true if the user answers y
+func askConfirmation(ui *jobsui.UI, question string) bool {
+	return strings.EqualFold(strings.TrimSpace(askUser(ui, question)), "y")
+}
 
-	bootloaderFirmwareName := "u-boot-arduino-lede.bin"
-	sysupgradeFirmwareName := "openwrt-ar71xx-generic-arduino-yun-squashfs-sysupgrade.bin"
+// recoverMcuBootloader runs the ISP recovery mode instead of the update
+func recoverMcuBootloader(ui *jobsui.UI, board *boardProfile, ispName, ispPort string) {
+	ui.AddJob("ispSignature", "Check MCU signature")
+	ui.AddJob("ispFuses", "Read MCU fuses")
+	ui.AddJob("ispBurn", "Burn MCU bootloader and fuses")
+	ui.AddJob("ispVerify", "Verify MCU fuses")
+
+	programmer, err := findIspProgrammer(ispName)
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	err = RecoverMcuBootloader(ui, board, programmer, ispPort, func(question string) bool {
+		return askConfirmation(ui, question)
+	})
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	report.save()
+	ui.SetStatus("Bootloader recovered! You may now run the update, or close the window")
+	log.Info("Bootloader recovered")
+	time.Sleep(10 * time.Second)
+}
+
+func main() {
 
 	serverAddr := ""
 	ipAddr := ""
 
 	flashBootloader := flag.Bool("bl", true, "Flash bootloader too (danger zone)")
-	targetBoard := flag.String("board", "Yun", "Update to target board")
+	targetBoard := flag.String("board", "Yun", "Update to target board, one of: "+strings.Join(boardNames(), ", "))
+	sketchPath := flag.String("sketch", "", "<optional> Flash this .hex, .elf or .bin sketch to the MCU instead of the stock firmware")
+	recipePath := flag.String("recipe", "", "<optional> U-Boot flash recipe to use instead of the board default one")
+	restoreEnvNames := flag.String("restore-env", "ethaddr", "U-Boot variables restored after flashing the bootloader, comma separated, e.g. ethaddr,bootargs,bootcmd")
+	mode := flag.String("mode", "auto", "Update from: auto (Linux sysupgrade when the bootloader is already current, U-Boot otherwise), uboot or linux")
+	keepConfig := flag.Bool("keep-config", false, "Preserve the Linux configuration when updating with sysupgrade from Linux")
+	transport := flag.String("transport", "auto", "Image transfer to the board: auto (TFTP, falling back to the serial port) or serial (slow, no network needed)")
+	policyPath := flag.String("policy", "", "<optional> JSON file with the retries, backoff and timeouts of the recipe stages")
+	stagePolicies := stagePolicyFlags{}
+	flag.Var(stagePolicies, "stage-policy", "<optional, repeatable> Stage policy as stage:field=value[,field=value], fields retries, backoff, timeout, timeout_per_mb in seconds, * for every stage")
+	runRetries := flag.Int("retries", defaultRunRetries, "<optional> Extra runs of the whole MPU flash after a failure")
+	backupSelection := flag.String("backup", "none", "Flash partitions saved before flashing: all, none or a comma separated list of u-boot, u-boot-env, firmware, art. Without tftpput they are read over the serial console at several minutes per megabyte, e.g. u-boot,u-boot-env,art adds a few minutes")
 
 	defaultServerAddr := flag.String("serverip", "", "<optional, only use if autodiscovery fails> Specify server IP address (this machine)")
 	defaultBoardAddr := flag.String("boardip", "", "<optional, only use if autodiscovery fails> Specify YUN IP address")
 
+	usbDevicesPath := flag.String("usb-devices", "", "<optional> JSON file with extra USB devices suitable for upload, same format as usb_devices.json")
+	extraUsbDevices := usbDeviceFlags{}
+	flag.Var(&extraUsbDevices, "usb-device", "<optional, repeatable> Extra USB device suitable for upload as vid:pid:profile[:bootloader|sketch[:name]]")
+
+	serialNumber := flag.String("serial-number", "", "<optional> USB serial number of the board to flash, when several boards are connected")
+	portName := flag.String("port", "", "<optional> Serial port of the board to flash, when several boards are connected")
+	restart := flag.Bool("restart", false, "<optional> Ignore the progress saved in "+runStateFileName+" by an interrupted run and start from the beginning")
+	dryRun := flag.Bool("dry-run", false, "<optional> Resolve the board, network and images and save the commands the run would send to "+dryRunFileName+", without touching the board")
+
+	simulate := flag.Bool("simulate", false, "<development> Run the MPU flash flow against a simulated board instead of hardware")
+	faults := flag.String("faults", "", "<development> Faults injected by the simulated board, comma separated name[=count] among "+simulationFaultHelp()+", e.g. tftp-drop=2,hang=crc32")
+	replayPath := flag.String("replay", "", "<development> Run the MPU flash flow against a serial transcript from the transcripts directory instead of a board")
+
+	ispName := flag.String("isp", "", "<recovery> Burn the MCU bootloader and fuses with this ISP programmer: usbasp, avrisp, arduinoisp, stk500v2")
+	ispPort := flag.String("isp-port", "", "<recovery> Serial port of the ISP programmer, not needed for usbasp")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [console | env dump | env get NAME | env set NAME [VALUE...]]\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	var command *envCommand
+	console := false
+	switch {
+	case flag.NArg() == 0:
+	case flag.Arg(0) == "env":
+		parsed, err := parseEnvCommand(flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		command = &parsed
+	case flag.Arg(0) == "console" && flag.NArg() == 1:
+		console = true
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	ui := jobsui.NewUI()
-	ui.AddJob("startTftp", "Start TFTP server")
-	ui.AddJob("findBoardAddress", "Find board IP address")
-	ui.AddJob("findOwnAddress", "Find own IP address")
-	ui.AddJob("findSerialPort", "Find serial port for upload")
-	ui.AddJob("uploadTerminalHex", "Flash MCU with serial terminal")
-	ui.AddJob("flashBootloader", "Flash MPU bootloader")
-	ui.AddJob("flashImage", "Flash MPU linux image")
-	ui.AddJob("findSerialPortFirmware", "Find serial port for upload")
-	ui.AddJob("uploadFirmware", "Flash MCU with final firmware")
-
-	// start tftp server, exit on failure
-	tftpErr := ServeTFTP()
-	if tftpErr != nil {
-		ui.SetJobStateWithInfo("startTftp", jobsui.Error, tftpErr.Error())
-		log.Error(tftpErr)
-		waitForKeyAndExit(ui, "unable to start TFTP server")
-	}
-	ui.SetJobState("startTftp", jobsui.Done)
 
-	serverAddr = *defaultServerAddr
-	ipAddr = *defaultBoardAddr
+	// reject unknown boards before touching the hardware
+	board, err := findBoardProfile(*targetBoard)
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	log.Infof("Using board profile: %s", board.name)
+	report.Board = board.name
 
-	if serverAddr == "" || ipAddr == "" {
-		ipErr := GetServerAndBoardIP(&serverAddr, &ipAddr)
-		if ipErr != nil {
-			ui.SetJobStateWithInfo("findBoardAddress", jobsui.Error, ipErr.Error())
-			ui.SetJobStateWithInfo("findOwnAddress", jobsui.Error, ipErr.Error())
-			log.Fatal(ipErr)
-			waitForKeyAndExit(ui, "unable to obtain self or board IP")
-		}
+	if *ispName != "" {
+		recoverMcuBootloader(ui, board, *ispName, *ispPort)
+		return
 	}
-	ui.SetJobStateWithInfo("findBoardAddress", jobsui.Done, ipAddr)
-	ui.SetJobStateWithInfo("findOwnAddress", jobsui.Done, serverAddr)
-	log.Infof("Using %s as server address and %s as board address", serverAddr, ipAddr)
 
-	// get serial ports attached
-	ui.SetStatus("Searching for suitable serial port...")
-	serialPortName, err := findSerialPortForFlashing()
+	if command == nil && !console && *replayPath == "" && !*simulate && !*dryRun {
+		ui.AddJob("startTftp", "Start TFTP server")
+		ui.AddJob("findBoardAddress", "Find board IP address")
+		ui.AddJob("findOwnAddress", "Find own IP address")
+		ui.AddJob("findSerialPort", "Find serial port for upload")
+		ui.AddJob("uploadTerminalHex", "Flash MCU with serial terminal")
+		ui.AddJob("checkBridge", "Check MCU serial bridge")
+		ui.AddJob("backupFlash", "Back up MPU flash")
+		ui.AddJob("flashBootloader", "Flash MPU bootloader")
+		ui.AddJob("flashImage", "Flash MPU linux image")
+		ui.AddJob("findSerialPortFirmware", "Find serial port for upload")
+		ui.AddJob("uploadFirmware", "Flash MCU with final firmware")
+	}
+
+	execDir, _ := os.Executable()
+	execDir = filepath.Dir(execDir)
+	avrDir := filepath.Join(execDir, "avr")
+
+	usbDevices, err := loadUsbDatabase(usbDatabasePaths(execDir, *usbDevicesPath)...)
+	for _, extra := range extraUsbDevices {
+		if err == nil {
+			err = usbDevices.add(extra)
+		}
+	}
 	if err != nil {
-		ui.SetJobStateWithInfo("findSerialPort", jobsui.Error, err.Error())
 		log.Error(err)
-		waitForKeyAndExit(ui, "unable to find serial port for flashing")
+		waitForKeyAndExit(ui, err.Error())
 	}
-	ui.SetJobStateWithInfo("findSerialPort", jobsui.Done, serialPortName)
 
-	hexName := "mcu_serial_terminal.hex"
-	ui.SetStatus(fmt.Sprintf("Flashing hex file: %s", hexName))
-	port, err := FlashHexFile(serialPortName, hexName)
+	// validate both MCU images before touching the hardware
+	terminalImage, err := loadMcuImage(filepath.Join(avrDir, board.images.terminalHex), board.mcu)
 	if err != nil {
-		ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Error, err.Error())
 		log.Error(err)
-		waitForKeyAndExit(ui, fmt.Sprintf("unable to flash %s", hexName))
+		waitForKeyAndExit(ui, err.Error())
 	}
-	ui.SetJobState("uploadTerminalHex", jobsui.Done)
 
-	// start the expecter
-	exp, _, err, serport := serialSpawn(port, time.Duration(10)*time.Second, expect.CheckDuration(100*time.Millisecond), expect.Verbose(false), expect.VerboseWriter(os.Stdout))
+	if *recipePath == "" {
+		*recipePath = filepath.Join(execDir, "recipes", board.recipe)
+	}
+	selector := &portSelector{serialNumber: *serialNumber, portName: *portName}
+	selector.choose = chooseCandidate(func(question string) string {
+		return askUser(ui, question)
+	})
+
+	// console and env only need the serial terminal, not the MPU images nor the network
+	if (console || command != nil) && *dryRun {
+		waitForKeyAndExit(ui, "dry-run plans the flash, it cannot be combined with env or console")
+	}
+	if console {
+		runConsole(ui, board, usbDevices, selector, terminalImage)
+		return
+	}
+	if command != nil {
+		ctx := context{flashBootloader: flashBootloader, board: board, transport: "serial"}
+		// the customer sketch is only replaced by one given on the command line
+		var sketchImage *mcuImage
+		if *sketchPath != "" {
+			sketchImage, err = loadMcuImage(*sketchPath, board.mcu)
+		}
+		if err == nil {
+			ctx.recipe, err = loadShellRecipe(*recipePath, ctx)
+		}
+		if err != nil {
+			log.Error(err)
+			waitForKeyAndExit(ui, err.Error())
+		}
+		runEnvCommand(ui, *command, ctx, usbDevices, selector, terminalImage, sketchImage)
+		return
+	}
+
+	firmwarePath := filepath.Join(avrDir, board.images.firmwareHex)
+	if *sketchPath != "" {
+		firmwarePath = *sketchPath
+	}
+	firmwareImage, err := loadMcuImage(firmwarePath, board.mcu)
 	if err != nil {
-		ui.SetJobStateWithInfo("flashBootloader", jobsui.Error, "Unable to spawn serial port")
-		log.Errorf("Unable to spawn serial port: %s", err.Error())
-		waitForKeyAndExit(ui, "unable to spawn serial port")
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	log.Infof("Final MCU firmware: %s (%d bytes, sha256 %s)", firmwareImage.name, firmwareImage.size, firmwareImage.checksum)
+	if *sketchPath != "" {
+		report.Sketch = &imageReport{Name: firmwareImage.name, Size: int64(firmwareImage.size), Checksum: firmwareImage.checksum}
 	}
 
-	execDir, _ := os.Executable()
-	execDir = filepath.Dir(execDir)
 	tftpDir := filepath.Join(execDir, "tftp")
 
-	bootloaderSize := getFileSize(filepath.Join(tftpDir, bootloaderFirmwareName))
-	sysupgradeSize := getFileSize(filepath.Join(tftpDir, sysupgradeFirmwareName))
+	err = board.checkMpuImages()
+	bootloaderFirmware := firmwareFile{}
+	if err == nil {
+		bootloaderFirmware, _, err = loadFirmwareFile(tftpDir, board.images.bootloader)
+	}
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	sysupgradeFirmware, err := loadSysupgradeFile(tftpDir, board)
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	log.Infof("Bootloader image %s: %d bytes, CRC32 %s", bootloaderFirmware.name, bootloaderFirmware.size, bootloaderFirmware.crc32)
+	log.Infof("Sysupgrade image %s: %d bytes, CRC32 %s, version %s", sysupgradeFirmware.name, sysupgradeFirmware.size, sysupgradeFirmware.crc32, sysupgradeFirmware.version)
+	report.Sysupgrade = &imageReport{Name: sysupgradeFirmware.name, Size: sysupgradeFirmware.size, Checksum: sysupgradeFirmware.crc32, Version: sysupgradeFirmware.version}
+
+	ctx := context{flashBootloader: flashBootloader, bootloaderFirmware: bootloaderFirmware, sysupgradeFirmware: sysupgradeFirmware, board: board, mode: *mode, keepConfig: *keepConfig}
+	switch *mode {
+	case "auto", "uboot", "linux":
+	default:
+		err = errors.Errorf("unknown mode %q, use auto, uboot or linux", *mode)
+	}
+	switch *transport {
+	case "auto":
+		ctx.transport = "tftp"
+	case "serial":
+		ctx.transport = "serial"
+	default:
+		err = errors.Errorf("unknown transport %q, use auto or serial", *transport)
+	}
+	if err == nil {
+		ctx.backupRegions, err = parseBackupSelection(*backupSelection, board.flash)
+	}
+	if err == nil {
+		ctx.restoreEnv, err = parseEnvNames(*restoreEnvNames)
+	}
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+
+	// load and validate the flash recipe before touching the hardware
+	ctx.recipe, err = loadRecipe(*recipePath)
+	recipes := []*flashRecipe{ctx.recipe}
+	if err == nil && ctx.mode != "uboot" && board.linuxRecipe != "" {
+		ctx.linuxRecipe, err = loadRecipe(filepath.Join(execDir, "recipes", board.linuxRecipe))
+		recipes = append(recipes, ctx.linuxRecipe)
+	} else if err == nil && ctx.mode == "linux" {
+		err = errors.Errorf("board %s has no Linux sysupgrade recipe", board.name)
+	}
+
+	// the policy file, then the flags, override the recipe retries and timeouts
+	policy := runPolicy{}
+	if err == nil && *policyPath != "" {
+		policy, err = loadRunPolicy(*policyPath)
+	}
+	for name, override := range stagePolicies {
+		policy.merge(name, override)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "retries" {
+			policy.Retries = runRetries
+		}
+	})
+	ctx.retries = policy.runRetries()
+	if err == nil {
+		err = policy.apply(recipes...)
+	}
+	for _, recipe := range recipes {
+		if err == nil {
+			err = validateRecipe(recipe, ctx)
+		}
+	}
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	for _, recipe := range recipes {
+		logPolicies(recipe, &ctx)
+	}
+	log.Infof("Using flash recipe %s", ctx.recipe.Name)
+
+	if *dryRun {
+		runDryRun(ui, ctx, *defaultServerAddr, *defaultBoardAddr, usbDevices, selector, terminalImage, firmwareImage)
+		return
+	}
+	if *replayPath != "" {
+		runReplay(ui, ctx, *replayPath)
+		return
+	}
+	if *simulate {
+		runSimulation(ui, ctx, *faults)
+		return
+	}
 
-	bootloaderFirmware := firmwareFile{name: bootloaderFirmwareName, size: bootloaderSize}
-	sysupgradeFirmware := firmwareFile{name: sysupgradeFirmwareName, size: sysupgradeSize}
+	// continue an interrupted run of the same images, every saved state is checked on the board again
+	images := map[string]string{"bootloader": bootloaderFirmware.crc32, "sysupgrade": sysupgradeFirmware.crc32, "firmware": firmwareImage.checksum}
+	if *restart {
+		ctx.state = newRunState(board.name, images)
+	} else {
+		ctx.state = loadRunState(board.name, images)
+	}
+
+	if ctx.transport == "serial" {
+		ui.SetJobStateWithInfo("startTftp", jobsui.Skipped, "serial transport")
+		ui.SetJobStateWithInfo("findBoardAddress", jobsui.Skipped, "serial transport")
+		ui.SetJobStateWithInfo("findOwnAddress", jobsui.Skipped, "serial transport")
+	} else {
+		// start tftp server, fall back to the serial port on failure
+		tftpErr := ServeTFTP()
+		if tftpErr != nil {
+			ui.SetJobStateWithInfo("startTftp", jobsui.Error, tftpErr.Error())
+			log.Errorf("Unable to start TFTP server: %s, falling back to serial transfer", tftpErr.Error())
+			ctx.transport = "serial"
+		} else {
+			ui.SetJobState("startTftp", jobsui.Done)
+		}
+	}
+	if ctx.linuxRecipe != nil && ctx.transport == "tftp" {
+		// wget on the board Linux does not speak TFTP, the Linux recipe falls back to serial without it
+		if ctx.httpPort, err = ServeHTTP(); err != nil {
+			log.Error(err)
+		}
+	}
 
-	ctx := context{flashBootloader: flashBootloader, serverAddr: serverAddr, ipAddr: ipAddr, bootloaderFirmware: bootloaderFirmware, sysupgradeFirmware: sysupgradeFirmware, targetBoard: targetBoard}
+	serverAddr = *defaultServerAddr
+	ipAddr = *defaultBoardAddr
 
-	lastline, err := FlashFirmwareAndBootlader(exp, ctx, ui)
+	if ctx.transport == "tftp" {
+		if serverAddr == "" || ipAddr == "" {
+			ipErr := GetServerAndBoardIP(&serverAddr, &ipAddr)
+			if ipErr != nil {
+				ui.SetJobStateWithInfo("findBoardAddress", jobsui.Error, ipErr.Error())
+				ui.SetJobStateWithInfo("findOwnAddress", jobsui.Error, ipErr.Error())
+				log.Errorf("Unable to obtain self or board IP: %s, falling back to serial transfer", ipErr.Error())
+				ctx.transport = "serial"
+			}
+		}
+		if ctx.transport == "tftp" {
+			ui.SetJobStateWithInfo("findBoardAddress", jobsui.Done, ipAddr)
+			ui.SetJobStateWithInfo("findOwnAddress", jobsui.Done, serverAddr)
+			log.Infof("Using %s as server address and %s as board address", serverAddr, ipAddr)
+		}
+	}
+
+	// get serial ports attached
+	ui.SetStatus("Searching for suitable serial port...")
+	serialPortName, device, err := findSerialPortForFlashing(board, usbDevices, selector)
+	if err != nil {
+		ui.SetJobStateWithInfo("findSerialPort", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, "unable to find serial port for flashing")
+	}
+	ui.SetJobStateWithInfo("findSerialPort", jobsui.Done, serialPortName+" ("+device.Name+")")
+	report.SerialNumber = selector.serialNumber
+
+	ctx.state.pin(selector.serialNumber)
+	report.ResumedFrom = ctx.state.last()
+
+	// a resumed run checks whether the serial terminal sketch is still running before flashing it
+	var exp expect.Expecter
+	var serport io.Closer
+	if ctx.state.reached(stateTerminalFlashed) {
+		ui.SetStatus("Checking MCU serial bridge...")
+		exp, serport, err = openBridge(serialPortName)
+		if err != nil {
+			log.Infof("Serial terminal not answering on %s: %s, flashing it again", serialPortName, err.Error())
+		} else {
+			ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Skipped, "already running")
+		}
+	}
+	if exp == nil {
+		ui.SetStatus(fmt.Sprintf("Flashing hex file: %s", terminalImage.name))
+		port, err := FlashHexFile(serialPortName, terminalImage, board.mcu, avrdudeStatusToUI(ui, terminalImage.name))
+		if err != nil {
+			ui.SetJobStateWithInfo("uploadTerminalHex", jobsui.Error, err.Error())
+			log.Error(err)
+			waitForKeyAndExit(ui, fmt.Sprintf("unable to flash %s", terminalImage.name))
+		}
+		// the port name may change on reset, follow the pinned board
+		port = selector.resolve(port)
+		ui.SetJobState("uploadTerminalHex", jobsui.Done)
+
+		// make sure the MPU console is reachable before rebooting into U-Boot
+		ui.SetStatus("Checking MCU serial bridge...")
+		exp, serport, err = openBridge(port)
+		if err != nil {
+			ui.SetJobStateWithInfo("checkBridge", jobsui.Error, err.Error())
+			log.Error(err)
+			waitForKeyAndExit(ui, err.Error())
+		}
+	}
+	ui.SetJobState("checkBridge", jobsui.Done)
+	ctx.state.reach(stateTerminalFlashed)
+
+	ctx.serverAddr = serverAddr
+	ctx.ipAddr = ipAddr
+
+	// a resumed run leaves the MPU alone if it already runs the flashed image
+	var lastline string
+	if ctx.state.reached(stateImageFlashed) && newRecipeRun(exp, ctx, ui).linuxReleaseCurrent() {
+		for _, job := range recipeJobs {
+			ui.SetJobStateWithInfo(job, jobsui.Skipped, "already flashed")
+		}
+	} else {
+		ctx.state.rewind(stateImageFlashed)
+		lastline, err = FlashFirmwareAndBootlader(exp, ctx, ui)
+	}
 
 	retryCount := 0
-	for err != nil && retryCount < 3 /* && strings.Contains(lastline, "Loading: T ")*/ {
+	for err != nil && retryCount < ctx.retries /* && strings.Contains(lastline, "Loading: T ")*/ {
 		//retry with different IP addresses
 		ui.SetStatus("Firmware upload failed, retrying")
-		log.Errorf("Firmware uload failed: %s, %s", lastline, err.Error())
-		GetServerAndBoardIP(&serverAddr, &ipAddr)
+		log.Errorf("Firmware upload attempt %d/%d failed: %s, %s", retryCount+1, ctx.retries+1, lastline, err.Error())
+		if ctx.transport == "tftp" {
+			GetServerAndBoardIP(&serverAddr, &ipAddr)
+		}
 		ctx.serverAddr = serverAddr
 		ctx.ipAddr = ipAddr
 		retryCount++
@@ -172,50 +564,84 @@ func main() {
 
 	// get serial ports attached
 	ui.SetStatus("Searching for suitable serial port...")
-	serialPortName, err = findSerialPortForFlashing()
+	serialPortName, device, err = findSerialPortForFlashing(board, usbDevices, selector)
 	if err != nil {
 		ui.SetJobStateWithInfo("findSerialPortFirmware", jobsui.Error, err.Error())
 		log.Error(err)
 		waitForKeyAndExit(ui, "unable to find serial port for flashing")
 	}
-	ui.SetJobStateWithInfo("findSerialPortFirmware", jobsui.Done, serialPortName)
+	ui.SetJobStateWithInfo("findSerialPortFirmware", jobsui.Done, serialPortName+" ("+device.Name+")")
 
-	// upload the YunSerialTerminal to the board
-	hexName = "mcu_firmware.hex"
-	ui.SetStatus(fmt.Sprintf("Flashing hex file: %s", hexName))
-	port, err = FlashHexFile(serialPortName, hexName)
+	// upload the final firmware to the board
+	ui.SetStatus(fmt.Sprintf("Flashing hex file: %s", firmwareImage.name))
+	_, err = FlashHexFile(serialPortName, firmwareImage, board.mcu, avrdudeStatusToUI(ui, firmwareImage.name))
 	if err != nil {
 		ui.SetJobStateWithInfo("uploadFirmware", jobsui.Error, err.Error())
 		log.Error(err)
-		waitForKeyAndExit(ui, fmt.Sprintf("unable to flash %s", hexName))
+		waitForKeyAndExit(ui, fmt.Sprintf("unable to flash %s", firmwareImage.name))
 	}
-	ui.SetJobState("uploadFirmware", jobsui.Done)
+	ui.SetJobStateWithInfo("uploadFirmware", jobsui.Done, firmwareImage.name)
+	ctx.state.reach(stateMcuFinal)
+	report.save()
 
 	ui.SetStatus("All done! You may now close the window, or wait 10s")
 	log.Info("All done! You may now close the window, or wait 10s")
 	time.Sleep(10 * time.Second)
 }
 
-func serialSpawn(port string, timeout time.Duration, opts ...expect.Option) (expect.Expecter, <-chan error, error, serial.Port) {
-	// open the port with safe parameters
-	mode := &serial.Mode{
-		BaudRate: 115200,
+// openBridge spawns an expecter on the port and checks that the serial terminal sketch bridges the MPU console
+func openBridge(port string) (expect.Expecter, io.Closer, error) {
+	exp, _, err, serport := serialSpawn(port, time.Duration(10)*time.Second, expect.CheckDuration(100*time.Millisecond), expect.Verbose(false), expect.VerboseWriter(os.Stdout))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Unable to spawn serial port")
+	}
+	if err := CheckSerialBridge(exp); err != nil {
+		exp.Close()
+		serport.Close()
+		return nil, nil, err
+	}
+	return exp, serport, nil
+}
+
+// serialSpawn opens the port and returns an expecter on it, a port named sim:FAULTS is a simulated board
+func serialSpawn(port string, timeout time.Duration, opts ...expect.Option) (expect.Expecter, <-chan error, error, io.Closer) {
+	var serPort io.ReadWriteCloser
+	var err error
+	if strings.HasPrefix(port, simulatedPortPrefix) {
+		serPort, err = newSimBoard(strings.TrimPrefix(port, simulatedPortPrefix))
+	} else {
+		// open the port with safe parameters
+		mode := &serial.Mode{
+			BaudRate: 115200,
+		}
+		serPort, err = serial.Open(port, mode)
 	}
-	serPort, err := serial.Open(port, mode)
 	if err != nil {
 		return nil, nil, err, nil
 	}
 
+	// record the whole session, the update goes on without a transcript if it cannot be written
+	var conn io.ReadWriteCloser = serPort
+	recorder, recErr := newSerialRecorder(serPort, port)
+	if recErr != nil {
+		log.Warn(recErr)
+	} else {
+		conn = recorder
+	}
+
 	resCh := make(chan error)
 
 	exp, ch, err := expect.SpawnGeneric(&expect.GenOptions{
-		In:  serPort,
-		Out: serPort,
+		In:  conn,
+		Out: conn,
 		Wait: func() error {
 			return <-resCh
 		},
 		Close: func() error {
 			close(resCh)
+			if recorder != nil {
+				recorder.Close()
+			}
 			return nil
 		},
 		Check: func() bool { return true },
@@ -224,38 +650,36 @@ func serialSpawn(port string, timeout time.Duration, opts ...expect.Option) (exp
 	return exp, ch, err, serPort
 }
 
-func findSerialPortForFlashing() (string, error) {
-	var serialPort enumerator.PortDetails
+// findSerialPortForFlashing returns the serial port of the board chosen by the selector among the ports
+// listed in the USB database for the given board
+func findSerialPortForFlashing(board *boardProfile, db usbDatabase, selector *portSelector) (string, *usbDevice, error) {
 	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	if len(ports) == 0 {
-		return "", errors.New("No serial ports were found")
+		return "", nil, errors.New("No serial ports were found")
 	}
-	// find port which is suitable for uplaod based on its VID and PID values
+	// find ports which are suitable for uplaod based on their VID and PID values
+	candidates := []portCandidate{}
 	for _, port := range ports {
 		if port.IsUSB {
 			log.Infof("Found serial port: %s ID: %s:%s Serial number: %s", port.Name, port.VID, port.PID, port.SerialNumber)
-			if canUse(port) {
-				log.Info("Using it")
-				serialPort = *port
-				break
+			known := db.lookup(port)
+			if known == nil {
+				continue
 			}
+			if !board.accepts(known.Profile) {
+				log.Infof("Skipping %s (%s), it needs board profile %s", port.Name, known.Name, known.Profile)
+				continue
+			}
+			candidates = append(candidates, portCandidate{port: port, device: known})
 		}
 	}
-	if serialPort.Name == "" {
-		return "", errors.New("No serial port suitable for upload")
-	}
-	return serialPort.Name, nil
-}
-
-func canUse(port *enumerator.PortDetails) bool {
-	if port.VID == "2341" && (port.PID == "8041" || port.PID == "0041" || port.PID == "8051" || port.PID == "0051") {
-		return true
-	}
-	if port.VID == "2a03" && (port.PID == "8041" || port.PID == "0041") {
-		return true
+	chosen, err := selector.selectPort(candidates)
+	if err != nil {
+		return "", nil, err
 	}
-	return false
+	log.Infof("Using %s in %s mode", chosen, chosen.device.Mode)
+	return chosen.port.Name, chosen.device, nil
 }
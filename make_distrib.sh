@@ -1,7 +1,7 @@
 #!/bin/bash -xe
 
 rm -rf distrib/
-mkdir -p distrib/{linux32,linux64,linuxarm,windows,osx}/{tftp,avr}
+mkdir -p distrib/{linux32,linux64,linuxarm,windows,osx}/{tftp,avr,recipes}
 
 export GOPATH=$PWD
 
@@ -9,13 +9,21 @@ u_boot_fw=u-boot-arduino-lede.bin
 sysupgrade_fw_name=openwrt-ar71xx-generic-arduino-yun-squashfs-sysupgrade.bin
 
 #check that sources match the real filename
-grep $sysupgrade_fw_name main.go
-grep $u_boot_fw main.go
+grep $sysupgrade_fw_name boards.go
+grep $u_boot_fw boards.go
+
+#fetch the MCU bootloaders used by the ISP recovery, named as in boards.go
+caterina_url=https://raw.githubusercontent.com/arduino/ArduinoCore-avr/1.8.6/bootloaders/caterina
+for hex in $(grep -o 'Caterina-[A-Za-z0-9]*\.hex' boards.go | sort -u); do
+	wget -O avr/$hex $caterina_url/$hex
+done
 
 #Linux32
 CGO_ENABLED=0 GOOS=linux GOARCH=386 GO386=387 go build -o distrib/linux32/yun-go-updater
 cp tftp/{$sysupgrade_fw_name,$u_boot_fw} distrib/linux32/tftp
 cp avr/*.hex distrib/linux32/avr/
+cp usb_devices.json distrib/linux32/
+cp recipes/*.json distrib/linux32/recipes/
 cd distrib/linux32/avr/
 wget http://downloads.arduino.cc/tools/avrdude-6.3.0-arduino8-i686-pc-linux-gnu.tar.bz2
 tar xvf *.tar.bz2
@@ -28,6 +36,8 @@ cd -
 CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o distrib/linux64/yun-go-updater
 cp tftp/{$sysupgrade_fw_name,$u_boot_fw} distrib/linux64/tftp
 cp avr/*.hex distrib/linux64/avr/
+cp usb_devices.json distrib/linux64/
+cp recipes/*.json distrib/linux64/recipes/
 cd distrib/linux64/avr/
 wget http://downloads.arduino.cc/tools/avrdude-6.3.0-arduino8-x86_64-pc-linux-gnu.tar.bz2
 tar xvf *.tar.bz2
@@ -40,6 +50,8 @@ cd -
 CGO_ENABLED=0 GOOS=linux GOARCH=arm go build -o distrib/linuxarm/yun-go-updater
 cp tftp/{$sysupgrade_fw_name,$u_boot_fw} distrib/linuxarm/tftp
 cp avr/*.hex distrib/linuxarm/avr/
+cp usb_devices.json distrib/linuxarm/
+cp recipes/*.json distrib/linuxarm/recipes/
 cd distrib/linuxarm/avr/
 wget http://downloads.arduino.cc/tools/avrdude-6.3.0-arduino8-armhf-pc-linux-gnu.tar.bz2
 tar xvf *.tar.bz2
@@ -52,6 +64,8 @@ cd -
 CGO_ENABLED=0 GOOS=windows GOARCH=386 GO386=387 go build -o distrib/windows/yun-go-updater.exe
 cp tftp/{$sysupgrade_fw_name,$u_boot_fw} distrib/windows/tftp
 cp avr/*.hex distrib/windows/avr/
+cp usb_devices.json distrib/windows/
+cp recipes/*.json distrib/windows/recipes/
 cd distrib/windows/avr/
 wget http://downloads.arduino.cc/tools/avrdude-6.3.0-arduino8-i686-w64-mingw32.zip
 unzip avrdude-6.3.0-arduino8-i686-w64-mingw32.zip
@@ -64,6 +78,8 @@ cd -
 CC=o64-clang GOOS=darwin GOARCH=amd64 go build -o distrib/osx/yun-go-updater
 cp tftp/{$sysupgrade_fw_name,$u_boot_fw} distrib/osx/tftp
 cp avr/*.hex distrib/osx/avr/
+cp usb_devices.json distrib/osx/
+cp recipes/*.json distrib/osx/recipes/
 cd distrib/osx/avr/
 wget http://downloads.arduino.cc/tools/avrdude-6.3.0-arduino8-i386-apple-darwin11.tar.bz2
 tar xvf *.tar.bz2
@@ -3,6 +3,8 @@ package main
 import (
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
@@ -10,9 +12,17 @@ import (
 	serial "go.bug.st/serial.v1"
 )
 
-// FlashHexFile flashes mcu connected to [port] serial port with hex file named [hexName]
-func FlashHexFile(port, hexName string) (string, error) {
-	port, err := reset(port, true)
+// FlashHexFile flashes mcu connected to [port] serial port with [image] using [mcu] avrdude settings,
+// avrdude progress is passed to [status] which may be nil
+func FlashHexFile(port string, image *mcuImage, mcu mcuProfile, status func(avrdudeStatus)) (string, error) {
+	// .elf and .bin images are only written as Intel HEX while avrdude runs
+	remove, err := image.writeConverted()
+	if err != nil {
+		return "", err
+	}
+	defer remove()
+
+	port, err = reset(port, true)
 	if err != nil {
 		return "", err
 	}
@@ -22,9 +32,7 @@ func FlashHexFile(port, hexName string) (string, error) {
 	execDir, _ := os.Executable()
 	execDir = filepath.Dir(execDir)
 	binDir := filepath.Join(execDir, "avr")
-	FWName := filepath.Join(binDir, hexName)
-	args := []string{"-C" + binDir + "/etc/avrdude.conf", "-v", "-patmega32u4", "-cavr109", "-P" + port, "-b57600", "-D", "-Uflash:w:" + FWName + ":i"}
-	err = ExecBinary(filepath.Join(binDir, "bin", "avrdude"), args)
+	_, err = execAvrdude(avrdudeBinary(binDir), avrdudeFlashArgs(binDir, image, mcu, port), status)
 	if err != nil {
 		return "", err
 	}
@@ -33,6 +41,11 @@ func FlashHexFile(port, hexName string) (string, error) {
 	return port, nil
 }
 
+// avrdudeFlashArgs returns the avrdude arguments writing [image] to the mcu on [port]
+func avrdudeFlashArgs(binDir string, image *mcuImage, mcu mcuProfile, port string) []string {
+	return []string{"-C" + binDir + "/etc/avrdude.conf", "-v", "-p" + mcu.part, "-c" + mcu.programmer, "-P" + port, "-b" + strconv.Itoa(mcu.baudRate), "-D", "-Uflash:w:" + image.path + ":i"}
+}
+
 // reset opens the port at 1200bps. It returns the new port name (which could change
 // sometimes) and an error (usually because the port listing failed)
 func reset(port string, wait bool) (string, error) {
@@ -151,3 +164,12 @@ func differ(slice1 []string, slice2 []string) string {
 
 	return ""
 }
+
+// avrdudeBinary returns the path of the avrdude binary shipped in [binDir]
+func avrdudeBinary(binDir string) string {
+	binary := filepath.Join(binDir, "bin", "avrdude")
+	if runtime.GOOS == "windows" {
+		binary += ".exe"
+	}
+	return binary
+}
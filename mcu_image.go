@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// mcuImage is a validated MCU program ready to be passed to avrdude
+type mcuImage struct {
+	name string
+	// path points to an Intel HEX file, for .elf and .bin images the temporary file written while flashing
+	path string
+	// converted is the program of .elf and .bin images, nil for .hex images
+	converted []byte
+	// size is the highest programmed address + 1
+	size int
+	// checksum is the sha256 of the source file
+	checksum string
+}
+
+// loadMcuImage reads and validates a .hex, .elf or .bin MCU image, .elf and .bin images are converted to Intel HEX
+func loadMcuImage(path string, mcu mcuProfile) (*mcuImage, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Read MCU image %s", path)
+	}
+	sum := sha256.Sum256(content)
+	image := &mcuImage{name: filepath.Base(path), path: path, checksum: hex.EncodeToString(sum[:])}
+
+	var program []byte
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hex":
+		program, err = parseIntelHex(content, mcu.maxSketchSize)
+	case ".elf":
+		program, err = readElfProgram(path)
+	case ".bin":
+		program = content
+	default:
+		err = errors.Errorf("unsupported extension, use .hex, .elf or .bin")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid MCU image %s", image.name)
+	}
+
+	image.size = len(program)
+	if image.size == 0 {
+		return nil, errors.Errorf("MCU image %s is empty", image.name)
+	}
+	if image.size > mcu.maxSketchSize {
+		return nil, errors.Errorf("MCU image %s is %d bytes, %s has room for %d bytes", image.name, image.size, mcu.part, mcu.maxSketchSize)
+	}
+
+	if strings.ToLower(filepath.Ext(path)) != ".hex" {
+		image.path = intelHexTempPath(image.name)
+		image.converted = program
+	}
+	return image, nil
+}
+
+// parseIntelHex decodes an Intel HEX file into a flat memory image starting at address 0, gaps are filled with 0xff,
+// data past limit is rejected before anything is allocated for it
+func parseIntelHex(content []byte, limit int) ([]byte, error) {
+	var program []byte
+	base := 0
+	eof := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if eof {
+			return nil, errors.Errorf("line %d: data after end of file record", line)
+		}
+		if text[0] != ':' {
+			return nil, errors.Errorf("line %d: missing start code", line)
+		}
+		record, err := hex.DecodeString(text[1:])
+		if err != nil || len(record) < 5 || len(record) != int(record[0])+5 {
+			return nil, errors.Errorf("line %d: malformed record", line)
+		}
+		var sum byte
+		for _, b := range record {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, errors.Errorf("line %d: checksum mismatch", line)
+		}
+		address := int(record[1])<<8 | int(record[2])
+		data := record[4 : len(record)-1]
+		switch record[3] {
+		case 0x00:
+			end := base + address + len(data)
+			if end > limit {
+				return nil, errors.Errorf("line %d: data up to address 0x%x, the MCU has room for %d bytes", line, end, limit)
+			}
+			for len(program) < end {
+				program = append(program, 0xff)
+			}
+			copy(program[base+address:], data)
+		case 0x01:
+			eof = true
+		case 0x02:
+			if len(data) != 2 {
+				return nil, errors.Errorf("line %d: malformed segment address", line)
+			}
+			base = (int(data[0])<<8 | int(data[1])) << 4
+		case 0x04:
+			if len(data) != 2 {
+				return nil, errors.Errorf("line %d: malformed linear address", line)
+			}
+			base = (int(data[0])<<8 | int(data[1])) << 16
+		case 0x03, 0x05:
+			// start address records are meaningless for the AVR
+		default:
+			return nil, errors.Errorf("line %d: unknown record type %d", line, record[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !eof {
+		return nil, errors.New("missing end of file record")
+	}
+	return program, nil
+}
+
+// readElfProgram extracts the loadable segments of an AVR ELF file into a flat flash image
+func readElfProgram(path string) ([]byte, error) {
+	file, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if file.Machine != elf.EM_AVR {
+		return nil, errors.Errorf("not an AVR executable (machine %s)", file.Machine)
+	}
+
+	var program []byte
+	for _, prog := range file.Progs {
+		// avr-gcc places RAM and EEPROM at 0x800000 and above, only flash is wanted here
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 || prog.Paddr >= 0x800000 {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return nil, err
+		}
+		end := int(prog.Paddr) + len(data)
+		for len(program) < end {
+			program = append(program, 0xff)
+		}
+		copy(program[prog.Paddr:], data)
+	}
+	return program, nil
+}
+
+// encodeIntelHex encodes a flat memory image as Intel HEX with 16 bytes per record
+func encodeIntelHex(program []byte) []byte {
+	var out bytes.Buffer
+	for offset := 0; offset < len(program); offset += 16 {
+		if offset > 0 && offset%0x10000 == 0 {
+			writeHexRecord(&out, 0, 0x04, []byte{byte(offset >> 24), byte(offset >> 16)})
+		}
+		end := offset + 16
+		if end > len(program) {
+			end = len(program)
+		}
+		writeHexRecord(&out, offset&0xffff, 0x00, program[offset:end])
+	}
+	writeHexRecord(&out, 0, 0x01, nil)
+	return out.Bytes()
+}
+
+func writeHexRecord(out *bytes.Buffer, address int, recordType byte, data []byte) {
+	record := append([]byte{byte(len(data)), byte(address >> 8), byte(address), recordType}, data...)
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	record = append(record, -sum)
+	fmt.Fprintf(out, ":%s\n", strings.ToUpper(hex.EncodeToString(record)))
+}
+
+// intelHexTempPath returns the temporary file holding the converted image, named after the source image
+func intelHexTempPath(name string) string {
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	return filepath.Join(os.TempDir(), "yun-go-updater-"+base+"-"+strconv.Itoa(os.Getpid())+".hex")
+}
+
+// writeConverted stores a converted image at its path, the returned function removes it
+func (m *mcuImage) writeConverted() (func(), error) {
+	if m.converted == nil {
+		return func() {}, nil
+	}
+	if err := ioutil.WriteFile(m.path, encodeIntelHex(m.converted), 0644); err != nil {
+		return nil, errors.Wrap(err, "Write converted MCU image")
+	}
+	return func() { os.Remove(m.path) }, nil
+}
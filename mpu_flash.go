@@ -1,7 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	expect "github.com/facchinm/goexpect"
@@ -10,220 +13,437 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// FlashFirmwareAndBootlader flashes the linux image and board bootloader if given cli argument was passed
-func FlashFirmwareAndBootlader(exp expect.Expecter, ctx context, ui *jobsui.UI) (string, error) {
-	ui.SetStatus("")
-	res, err := exp.ExpectBatch([]expect.Batcher{
-		&expect.BSnd{S: "\n"},
-		&expect.BExp{R: "root@"},
-		&expect.BSnd{S: "reboot -f\n"},
-	}, time.Duration(5)*time.Second)
-
-	if err != nil {
-		ui.SetStatus("Reboot the board using YUN RST button")
-		log.Info("Reboot the board using YUN RST button")
-	} else {
-		ui.SetStatus("Rebooting the board")
-		log.Info("Rebooting the board")
-	}
+// recipeRun holds the state of a flash recipe running on the board console
+type recipeRun struct {
+	exp  expect.Expecter
+	ctx  *context
+	ui   *jobsui.UI
+	vars map[string]string
+	// guard checks every erase and copy before it is sent
+	guard *flashGuard
+	// console collects the output matched so far
+	console strings.Builder
+	// saved holds the flash regions read during the run
+	saved map[string][]byte
+	// uboot is the bootloader fingerprint, nil until the recipe takes it
+	uboot *ubootFingerprint
+	// art is the ART and MAC address fingerprint taken before flashing
+	art *artFingerprint
+	// envBefore is the U-Boot environment before the bootloader is flashed
+	envBefore bootEnv
+	// stage is the running stage, for the hooks it calls
+	stage *recipeStage
+}
 
-	err = nil
+// recipeJobs are the UI jobs a recipe stage may update
+var recipeJobs = []string{"backupFlash", "flashBootloader", "flashImage"}
 
-	// in bootloader mode:
-	// understand which version of the BL we are in
-	res, err = exp.ExpectBatch([]expect.Batcher{
-		&expect.BExp{R: "(stop with '([a-z]+)'|Hit any key to stop autoboot|type '([a-z]+)' to enter u-boot console)"},
-	}, time.Duration(20)*time.Second)
+// recipeHooks are the actions a recipe stage can run before being retried, or call as a step
+var recipeHooks = map[string]func(r *recipeRun) error{
+	// rediscover_ip looks for other server and board addresses, e.g. on another network interface
+	"rediscover_ip": func(r *recipeRun) error {
+		// images go over the console with the serial transport, a run without a network must not wait for one
+		if r.vars["transport"] == "serial" {
+			return nil
+		}
+		err := GetServerAndBoardIP(&r.ctx.serverAddr, &r.ctx.ipAddr)
+		r.vars["serverip"] = r.ctx.serverAddr
+		r.vars["ipaddr"] = r.ctx.ipAddr
+		return err
+	},
+	// detect_flash reads the flash size from flinfo, mtdparts (alone or in bootargs) or the boot banner seen so far
+	"detect_flash": func(r *recipeRun) error {
+		output := r.console.String()
+		for _, command := range []string{"flinfo", "printenv mtdparts", "printenv bootargs"} {
+			out, err := r.command(command, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			output = out + output
+		}
+		size, source := detectFlashSize(output)
+		if err := r.guard.setDetectedSize(size, source); err != nil {
+			return err
+		}
+		r.vars["flash_size"] = hexAddr(r.guard.size)
+		return nil
+	},
+	// backup_flash saves the partitions selected on the command line, the network must be set up
+	"backup_flash": backupFlash,
+	// fingerprint_art reads ART before flashing, the network must be set up
+	"fingerprint_art": fingerprintArt,
+	// check_art restores ART and ethaddr if they changed since fingerprint_art
+	"check_art": checkArt,
+	// snapshot_env saves the U-Boot environment before the bootloader is flashed
+	"snapshot_env": snapshotEnv,
+	// restore_env shows the environment changes and restores the variables chosen on the command line
+	"restore_env": restoreEnv,
+	// upload_linux writes the stage image to /tmp from the Linux shell, when the network is not available
+	"upload_linux": uploadLinux,
+	// verify_boot follows the boot until the Linux shell and checks the release against the flashed image
+	"verify_boot": verifyBoot,
+	// fingerprint_uboot identifies the bootloader and sets the {{uboot.*}} capability variables
+	"fingerprint_uboot": fingerprintUboot,
+	// md_crc32_ram sets ram_crc32 from md.b hexdumps of the stage image loaded in RAM, when U-Boot has no crc32
+	"md_crc32_ram": func(r *recipeRun) error {
+		return r.dumpImageCrc("ram_crc32", false)
+	},
+	// md_crc32_flash sets flash_crc32 from md.b hexdumps of the stage image written to flash, when U-Boot has no crc32
+	"md_crc32_flash": func(r *recipeRun) error {
+		return r.dumpImageCrc("flash_crc32", true)
+	},
+	// load_serial sends the stage image to RAM with loadb, when the network is not available
+	"load_serial": func(r *recipeRun) error {
+		if r.stage == nil || r.stage.Image == "" {
+			return errors.New("load_serial needs a stage image")
+		}
+		name := r.vars[r.stage.Image+".name"]
+		content, err := ioutil.ReadFile(servedFilePath(name))
+		if err != nil {
+			return errors.Wrap(err, "Read firmware image")
+		}
+		return r.loadSerial(name, content)
+	},
+}
 
-	if err != nil {
-		return "", err
-	}
+// recipeShellStage is the recipe stage after which the U-Boot shell is ready for commands
+const recipeShellStage = "stop"
 
-	stopCommand := res[0].Match[len(res[0].Match)-1]
+func newRecipeRun(exp expect.Expecter, ctx context, ui *jobsui.UI) *recipeRun {
+	return &recipeRun{exp: exp, ctx: &ctx, ui: ui, vars: recipeVariables(ctx), guard: newFlashGuard(ctx.board.flash)}
+}
 
-	if stopCommand == "" {
-		stopCommand = res[0].Match[len(res[0].Match)-2]
+// FlashFirmwareAndBootlader flashes the linux image and board bootloader if given cli argument was passed,
+// following the board flash recipe
+func FlashFirmwareAndBootlader(exp expect.Expecter, ctx context, ui *jobsui.UI) (string, error) {
+	ui.SetStatus("")
+	run := newRecipeRun(exp, ctx, ui)
+	var recipe *flashRecipe
+	next := 0
+	// a retry continues after the last confirmed state if the board is still in the U-Boot shell
+	if checkpoint := ctx.state.resume(ctx); checkpoint != nil {
+		run, recipe, next = checkpoint.run, checkpoint.recipe, checkpoint.next
+	} else {
+		var err error
+		if recipe, err = run.chooseRecipe(); err != nil {
+			return "", err
+		}
 	}
-
-	if res[0].Match[0] == "Hit any key to stop autoboot" {
-		log.Info("Old YUN detected")
-		stopCommand = ""
+	output := ""
+	for i := next; i < len(recipe.Stages); i++ {
+		stage := recipe.Stages[i]
+		var err error
+		output, err = run.runStage(stage)
+		if err != nil {
+			return output, err
+		}
+		if stage.State != "" && ctx.state.reached(stage.State) {
+			ctx.state.checkpoint = &runCheckpoint{run: run, recipe: recipe, next: i + 1}
+		}
 	}
+	return output, nil
+}
 
-	log.Infof("Using stop command: %s", stopCommand)
-	ui.SetStatus("Board rebooted, flashing...")
-
-	// call stop and detect firmware version (if it needs to be updated)
-	res, err = exp.ExpectBatch([]expect.Batcher{
-		&expect.BSnd{S: stopCommand + "\n"},
-		&expect.BSnd{S: "printenv ipaddr\n"},
-		&expect.BExp{R: "([0-9a-zA-Z]+)>"},
-	}, time.Duration(5)*time.Second)
-
-	if err != nil {
-		return "", err
+// OpenUbootShell reboots the board into the U-Boot shell running the recipe stages up to recipeShellStage,
+// the returned run sends further commands
+func OpenUbootShell(exp expect.Expecter, ctx context, ui *jobsui.UI) (*recipeRun, error) {
+	run := newRecipeRun(exp, ctx, ui)
+	for _, stage := range ctx.recipe.Stages {
+		if _, err := run.runStage(stage); err != nil {
+			return nil, err
+		}
+		if stage.Name == recipeShellStage {
+			// the commands sent afterwards are not bound by the stage timeout
+			run.stage = nil
+			return run, nil
+		}
 	}
+	return nil, errors.Errorf("recipe %s has no %s stage", ctx.recipe.Name, recipeShellStage)
+}
 
-	fwShell := res[0].Match[len(res[0].Match)-1]
-	log.Infof("Got shell: %s", fwShell)
-
-	if fwShell != "arduino" {
-		*ctx.flashBootloader = true
-		log.Infof("fwShell: %s", fwShell)
+// recipeVariables returns the variables known before the recipe starts
+func recipeVariables(ctx context) map[string]string {
+	board := ctx.board
+	flash := board.flash
+	vars := map[string]string{
+		"serverip":           ctx.serverAddr,
+		"ipaddr":             ctx.ipAddr,
+		"board":              board.envName,
+		"load_addr":          hexAddr(flash.loadAddr),
+		"env_addr":           hexAddr(flash.envAddr),
+		"env_size":           hexAddr(flash.envSize),
+		"env_sectors":        strconv.FormatInt(flash.sectors(flash.envSize), 10),
+		"uboot_stop_pattern": board.uboot.stopPattern,
+		"uboot_shell":        board.uboot.shell,
+		"uboot_stop":         board.uboot.stopWord,
+		"flash_bootloader":   strconv.FormatBool(*ctx.flashBootloader && !ctx.state.reached(stateBootloaderFlashed)),
+		"flash_size":         hexAddr(flash.size),
+		"backup":             strconv.FormatBool(len(ctx.backupRegions) > 0),
+		"backup_dir":         "",
+		"transport":          ctx.transport,
+		"http_port":          strconv.Itoa(ctx.httpPort),
+		"sysupgrade_args":    "-n",
+		"linux_release":      "",
 	}
+	for name, value := range ubootVariables() {
+		vars[name] = value
+	}
+	if ctx.keepConfig {
+		vars["sysupgrade_args"] = ""
+	}
+	for name, value := range imageVariables("bootloader", ctx.bootloaderFirmware, flash.bootloaderAddr, flash.bootloaderSize, flash) {
+		vars[name] = value
+	}
+	for name, value := range imageVariables("sysupgrade", ctx.sysupgradeFirmware, flash.firmwareAddr, flash.firmwareSize, flash) {
+		vars[name] = value
+	}
+	return vars
+}
 
-	time.Sleep(1 * time.Second)
-
-	if *ctx.flashBootloader {
-
-		log.Info("Flashing Bootloader")
-		ui.SetStatus("Flashing bootloader...")
+// runStage runs the stage if its conditions hold, retrying it as the recipe says
+func (r *recipeRun) runStage(stage recipeStage) (string, error) {
+	if !r.shouldRun(stage) {
+		log.Infof("Recipe stage %s skipped", stage.Name)
+		if stage.Job != "" && stage.Done {
+			r.ui.SetJobState(stage.Job, jobsui.Skipped)
+		}
+		return "", nil
+	}
 
-		err = errors.New("ping")
+	log.Infof("Recipe stage %s", stage.Name)
+	r.stage = &stage
+	if stage.Status != "" {
+		status, _ := expandVariables(stage.Status, bindImage(stage.Image, r.vars))
+		r.ui.SetStatus(status)
+	}
 
-		retry := 0
-		for err != nil && retry < 4 {
-			// set server and board ip
-			res, err = exp.ExpectBatch([]expect.Batcher{
-				&expect.BSnd{S: "setenv serverip " + ctx.serverAddr + "\n"},
-				&expect.BExp{R: fwShell + ">"},
-				&expect.BSnd{S: "printenv serverip\n"},
-				&expect.BExp{R: "serverip=" + ctx.serverAddr},
-				&expect.BSnd{S: "setenv ipaddr " + ctx.ipAddr + "\n"},
-				&expect.BSnd{S: "printenv ipaddr\n"},
-				&expect.BExp{R: "ipaddr=" + ctx.ipAddr},
-				&expect.BSnd{S: "ping " + ctx.serverAddr + "\n"},
-				&expect.BExp{R: "host " + ctx.serverAddr + " is alive"},
-			}, time.Duration(10)*time.Second)
-			retry++
-			if err != nil {
-				GetServerAndBoardIP(&ctx.serverAddr, &ctx.ipAddr)
+	output, err := r.attempt(stage)
+	for retry := 0; err != nil && retry < stage.Retries; retry++ {
+		delay := retryDelay(stage, retry)
+		log.Infof("Recipe stage %s attempt %d/%d failed: %s, retrying in %s", stage.Name, retry+1, stage.Retries+1, err.Error(), delay)
+		time.Sleep(delay)
+		if stage.OnRetry != "" {
+			if hookErr := recipeHooks[stage.OnRetry](r); hookErr != nil {
+				log.Errorf("Recipe hook %s failed: %s", stage.OnRetry, hookErr.Error())
 			}
 		}
+		output, err = r.attempt(stage)
+	}
 
-		if err != nil {
-			ui.SetJobStateWithInfo("flashBootloader", jobsui.Error, err.Error())
-			return res[len(res)-1].Output, err
-		}
-
-		time.Sleep(2 * time.Second)
-
-		// flash new bootloader
-		res, err = exp.ExpectBatch([]expect.Batcher{
-			&expect.BSnd{S: "printenv ipaddr\n"},
-			&expect.BExp{R: fwShell + ">"},
-			&expect.BSnd{S: "tftp 0x80060000 " + ctx.bootloaderFirmware.name + "\n"},
-			&expect.BExp{R: "Bytes transferred = " + strconv.FormatInt(ctx.bootloaderFirmware.size, 10)},
-			&expect.BSnd{S: "erase 0x9f000000 +0x40000\n"},
-			&expect.BExp{R: "Erased 4 sectors"},
-			&expect.BSnd{S: "cp.b $fileaddr 0x9f000000 $filesize\n"},
-			&expect.BExp{R: "done"},
-			&expect.BSnd{S: "erase 0x9f040000 +0x10000\n"},
-			&expect.BExp{R: "Erased 1 sectors"},
-			&expect.BSnd{S: "reset\n"},
-		}, time.Duration(30)*time.Second)
-
-		if err != nil {
-			ui.SetJobStateWithInfo("flashBootloader", jobsui.Error, err.Error())
-			return res[len(res)-1].Output, err
+	if err != nil {
+		if stage.Optional {
+			log.Infof("Optional recipe stage %s failed: %s", stage.Name, err.Error())
+			for name, value := range stage.SetFailed {
+				r.vars[name], _ = expandVariables(value, r.vars)
+			}
+			if stage.StatusFailed != "" {
+				r.ui.SetStatus(stage.StatusFailed)
+				log.Info(stage.StatusFailed)
+			}
+			return output, nil
 		}
+		if stage.Job != "" {
+			r.ui.SetJobStateWithInfo(stage.Job, jobsui.Error, err.Error())
+		}
+		return output, err
+	}
 
-		// New bootloader flashed, stop with 'ard' and shell is 'arduino>'
+	for name, value := range stage.Set {
+		r.vars[name], _ = expandVariables(value, r.vars)
+	}
+	if stage.State != "" {
+		r.ctx.state.reach(stage.State)
+	}
+	if stage.StatusDone != "" {
+		status, _ := expandVariables(stage.StatusDone, bindImage(stage.Image, r.vars))
+		r.ui.SetStatus(status)
+		log.Info(status)
+	}
+	if stage.Job != "" && stage.Done {
+		if stage.DoneInfo != "" {
+			info, _ := expandVariables(stage.DoneInfo, bindImage(stage.Image, r.vars))
+			r.ui.SetJobStateWithInfo(stage.Job, jobsui.Done, info)
+			log.Infof("%s: %s", stage.Job, info)
+		} else {
+			r.ui.SetJobState(stage.Job, jobsui.Done)
+		}
+	}
+	return output, nil
+}
 
-		time.Sleep(1 * time.Second)
+// shouldRun returns true if any of the stage conditions holds, or if the stage has none
+func (r *recipeRun) shouldRun(stage recipeStage) bool {
+	if len(stage.When) == 0 {
+		return true
+	}
+	for _, condition := range stage.When {
+		// conditions are checked when the recipe is loaded
+		if holds, _ := evalCondition(condition, r.vars); holds {
+			return true
+		}
+	}
+	return false
+}
 
-		// set new name
-		res, err = exp.ExpectBatch([]expect.Batcher{
-			&expect.BExp{R: "autoboot in"},
-			&expect.BSnd{S: "ard\n"},
-			&expect.BExp{R: "arduino>"},
-			&expect.BSnd{S: "printenv ipaddr\n"},
-			&expect.BExp{R: "arduino>"},
-			&expect.BSnd{S: "setenv board " + *ctx.targetBoard + "\n"},
-			&expect.BExp{R: "arduino>"},
-			&expect.BSnd{S: "saveenv\n"},
-			&expect.BExp{R: "arduino>"},
-		}, time.Duration(10)*time.Second)
+// attempt runs the stage steps once, sleeps, checks and messages split the steps into separate expect batches
+func (r *recipeRun) attempt(stage recipeStage) (string, error) {
+	vars := bindImage(stage.Image, r.vars)
+	timeout := stageTimeout(stage, r.ctx)
+	batch := []expect.Batcher{}
+	steps := []recipeStep{}
+	output := ""
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		res, err := r.exp.ExpectBatch(batch, timeout)
+		if len(res) > 0 {
+			output = res[len(res)-1].Output
+		}
+		for _, result := range res {
+			r.console.WriteString(result.Output)
+			for name, group := range steps[result.Idx].Capture {
+				r.vars[name] = captureValue(result.Match, group)
+				log.Infof("Recipe captured %s=%s", name, r.vars[name])
+			}
+		}
+		batch = batch[:0]
+		steps = steps[:0]
+		return err
+	}
 
-		if err != nil {
-			ui.SetJobStateWithInfo("flashBootloader", jobsui.Error, err.Error())
-			return res[len(res)-1].Output, err
+	env := imageEnv(stage, r.ctx)
+	for _, step := range stage.Steps {
+		if step.When != "" {
+			if holds, _ := evalCondition(step.When, vars); !holds {
+				continue
+			}
 		}
-		ui.SetJobState("flashBootloader", jobsui.Done)
-		ui.SetStatus("Bootloader flashing done")
-	} else {
-		log.Info("Bootloader flash skipped")
-		ui.SetJobState("flashBootloader", jobsui.Skipped)
-	}
-
-	log.Info("Setting up IP addresses")
-
-	err = errors.New("ping")
-	retry := 0
-	for err != nil && retry < 4 {
-		// set server and board ip
-		res, err = exp.ExpectBatch([]expect.Batcher{
-			&expect.BSnd{S: "setenv serverip " + ctx.serverAddr + "\n"},
-			&expect.BExp{R: fwShell + ">"},
-			&expect.BSnd{S: "printenv serverip\n"},
-			&expect.BExp{R: "serverip=" + ctx.serverAddr},
-			&expect.BSnd{S: "setenv ipaddr " + ctx.ipAddr + "\n"},
-			&expect.BSnd{S: "printenv ipaddr\n"},
-			&expect.BExp{R: "ipaddr=" + ctx.ipAddr},
-			&expect.BSnd{S: "ping " + ctx.serverAddr + "\n"},
-			&expect.BExp{R: "host " + ctx.serverAddr + " is alive"},
-		}, time.Duration(10)*time.Second)
-		retry++
-		if err != nil {
-			GetServerAndBoardIP(&ctx.serverAddr, &ctx.ipAddr)
+		switch {
+		case step.Sleep > 0:
+			if err := flush(); err != nil {
+				return output, err
+			}
+			time.Sleep(time.Duration(step.Sleep) * time.Second)
+			continue
+		case step.Check != "":
+			if err := flush(); err != nil {
+				return output, err
+			}
+			vars = bindImage(stage.Image, r.vars)
+			if holds, _ := evalCondition(step.Check, vars); !holds {
+				message, _ := expandVariables(step.Fail, vars)
+				if message == "" {
+					message, _ = expandVariables(step.Check, vars)
+					message = "recipe check failed: " + message
+				}
+				return output, errors.New(message)
+			}
+			continue
+		case step.Show != "":
+			if err := flush(); err != nil {
+				return output, err
+			}
+			vars = bindImage(stage.Image, r.vars)
+			message, _ := expandVariables(step.Show, vars)
+			r.ui.SetStatus(message)
+			log.Info(message)
+			continue
+		case step.Call != "":
+			if err := flush(); err != nil {
+				return output, err
+			}
+			if err := recipeHooks[step.Call](r); err != nil {
+				return output, errors.Wrap(err, step.Call)
+			}
+			vars = bindImage(stage.Image, r.vars)
+			continue
+		case step.Send != nil:
+			text, _ := expandVariables(*step.Send, vars)
+			if err := r.guard.checkCommand(text, env); err != nil {
+				return output, err
+			}
+			batch = append(batch, &expect.BSnd{S: text + "\n"})
+		default:
+			pattern, _ := expandVariables(step.Expect, vars)
+			batch = append(batch, &expect.BExp{R: pattern})
 		}
+		steps = append(steps, step)
 	}
+	return output, flush()
+}
 
+// command sends a U-Boot command and returns its output up to the next prompt, within the stage timeout
+func (r *recipeRun) command(command string, timeout time.Duration) (string, error) {
+	if r.stage != nil && r.stage.Timeout > 0 {
+		if limit := stageTimeout(*r.stage, r.ctx); limit < timeout {
+			timeout = limit
+		}
+	}
+	// the prompt after the echo, a prompt left over from an earlier step is skipped
+	prompt := regexp.MustCompile(regexp.QuoteMeta(command) + "(?s:.*?)" + regexp.QuoteMeta(r.vars["shell"]+">"))
+	if err := r.exp.Send(command + "\n"); err != nil {
+		return "", err
+	}
+	output, _, err := r.exp.Expect(prompt, timeout)
 	if err != nil {
-		ui.SetJobStateWithInfo("flashImage", jobsui.Error, err.Error())
-		return res[len(res)-1].Output, err
+		return output, errors.Wrap(err, command)
 	}
+	return output, nil
+}
 
-	log.Info("Flashing sysupgrade image")
-	ui.SetStatus("Flashing sysupgrade image...")
+// writeCommand sends an erase or copy command outside of the recipe steps, after checking it with the flash guard
+func (r *recipeRun) writeCommand(command string, env map[string]int64, timeout time.Duration) (string, error) {
+	if err := r.guard.checkCommand(command, env); err != nil {
+		return "", err
+	}
+	return r.command(command, timeout)
+}
 
-	// ping the serverIP; if ping is not working, try another network interface
-	/*
-		res, err = exp.ExpectBatch([]expect.Batcher{
-			&expect.BSnd{S: "ping " + ctx.serverAddr + "\n"},
-			&expect.BExp{R: "is alive"},
-		}, time.Duration(6)*time.Second)
+// validateRecipe checks the recipe against the board with representative values for the addresses
+func validateRecipe(recipe *flashRecipe, ctx context) error {
+	vars := recipeVariables(ctx)
+	for _, name := range []string{"serverip", "ipaddr"} {
+		if vars[name] == "" {
+			vars[name] = "0.0.0.0"
+		}
+	}
+	if err := recipe.validate(vars, recipeJobs); err != nil {
+		return err
+	}
 
-		if err != nil {
-			return res[len(res)-1].Output, err
-		}
-	*/
-
-	time.Sleep(2 * time.Second)
-
-	// flash sysupgrade
-	res, err = exp.ExpectBatch([]expect.Batcher{
-		&expect.BSnd{S: "printenv board\n"},
-		&expect.BExp{R: "board=" + *ctx.targetBoard},
-		&expect.BSnd{S: "tftp 0x80060000 " + ctx.sysupgradeFirmware.name + "\n"},
-		&expect.BExp{R: "Bytes transferred = " + strconv.FormatInt(ctx.sysupgradeFirmware.size, 10)},
-		&expect.BSnd{S: `erase 0x9f050000 +0x` + strconv.FormatInt(ctx.sysupgradeFirmware.size, 16) + "\n"},
-		&expect.BExp{R: "Erased [0-9]+ sectors"},
-		&expect.BSnd{S: "printenv serverip\n"},
-		&expect.BExp{R: "arduino>"},
-		&expect.BSnd{S: "cp.b $fileaddr 0x9f050000 $filesize\n"},
-		&expect.BExp{R: "done"},
-		&expect.BSnd{S: "printenv serverip\n"},
-		&expect.BExp{R: "arduino>"},
-		&expect.BSnd{S: "reset\n"},
-		&expect.BExp{R: "Transferring control to Linux"},
-	}, time.Duration(90)*time.Second)
+	// refuse recipes writing outside the writable partitions, captured values are not known yet
+	guard := newFlashGuard(ctx.board.flash)
+	for _, stage := range recipe.Stages {
+		stageVars := bindImage(stage.Image, vars)
+		env := imageEnv(stage, &ctx)
+		for _, step := range stage.Steps {
+			if step.Send == nil {
+				continue
+			}
+			text, _ := expandVariables(*step.Send, stageVars)
+			if err := guard.checkCommand(text, env); err != nil {
+				return errors.Wrapf(err, "recipe %s, stage %s", recipe.Name, stage.Name)
+			}
+		}
+	}
+	return nil
+}
 
-	if err != nil {
-		ui.SetJobStateWithInfo("flashImage", jobsui.Error, err.Error())
-		return res[len(res)-1].Output, err
+// imageEnv returns the U-Boot variables set by a tftp of the stage image, the only ones erase and copy may use
+func imageEnv(stage recipeStage, ctx *context) map[string]int64 {
+	env := map[string]int64{}
+	var image firmwareFile
+	switch stage.Image {
+	case "bootloader":
+		image = ctx.bootloaderFirmware
+	case "sysupgrade":
+		image = ctx.sysupgradeFirmware
+	default:
+		return env
 	}
-	ui.SetJobState("flashImage", jobsui.Done)
-	ui.SetStatus("Sysupgrade image flashing done")
-	return res[len(res)-1].Output, nil
+	env["fileaddr"] = ctx.board.flash.loadAddr
+	env["filesize"] = image.size
+	return env
 }
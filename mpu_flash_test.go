@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	expect "github.com/facchinm/goexpect"
+	jobsui "github.com/mic90/go-jobs-ui"
+)
+
+var simTFTP struct {
+	sync.Once
+	err error
+}
+
+// startSimTFTP serves the test images from an ephemeral loopback port, the simulated board fetches from it
+func startSimTFTP(t *testing.T) {
+	simTFTP.Do(func() {
+		tftpAddr = "127.0.0.1:0"
+		simTFTP.err = ServeTFTP()
+	})
+	if simTFTP.err != nil {
+		t.Fatal(simTFTP.err)
+	}
+}
+
+// testSysupgradeImage builds a sysupgrade image the updater and the simulated board accept: a uImage
+// kernel, the squashfs magic and the fwtool metadata
+func testSysupgradeImage(board *boardProfile) []byte {
+	kernel := bytes.Repeat([]byte("kernel~0#\x01\x7f\xfe"), 0x1000)
+	header := make([]byte, uImageHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], uImageMagic)
+	binary.BigEndian.PutUint32(header[12:], uint32(len(kernel)))
+	binary.BigEndian.PutUint32(header[16:], uint32(board.flash.kernelLoadAddr))
+	binary.BigEndian.PutUint32(header[24:], crc32.ChecksumIEEE(kernel))
+	header[28], header[29], header[30] = uImageOsLinux, uImageArchMips, uImageTypeKernel
+	copy(header[32:], "MIPS LEDE Linux-4.4.61")
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(header))
+
+	image := append(header, kernel...)
+	image = append(image, squashfsMagic...)
+	image = append(image, make([]byte, 0x1000)...)
+	metadata := fwtoolMetadata{SupportedDevices: board.images.sysupgradeDevices}
+	metadata.Version.Dist, metadata.Version.Version, metadata.Version.Revision = "LEDE", "17.01.4", "r3560"
+	content, _ := json.Marshal(metadata)
+	block := append(make([]byte, 8), content...)
+	trailer := make([]byte, fwtoolTrailerSize)
+	binary.BigEndian.PutUint32(trailer[0:], fwtoolMagic)
+	trailer[8] = fwtoolTypeInfo
+	binary.BigEndian.PutUint32(trailer[12:], uint32(len(block)+fwtoolTrailerSize))
+	return append(append(image, block...), trailer...)
+}
+
+// simTestContext writes the images to a temporary directory, serves them and returns the context of a
+// run against the simulated board with the given stage policies
+func simTestContext(t *testing.T, dir string, policies ...string) context {
+	board := &boardProfiles[0]
+	bootloader := bytes.Repeat([]byte("u-boot\x00\xff"), 0x2000)
+	if err := ioutil.WriteFile(filepath.Join(dir, board.images.bootloader), bootloader, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, board.images.sysupgrade), testSysupgradeImage(board), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bootloaderFirmware, _, err := loadFirmwareFile(dir, board.images.bootloader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysupgradeFirmware, err := loadSysupgradeFile(dir, board)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{board.images.bootloader, board.images.sysupgrade} {
+		serveFile(name, filepath.Join(dir, name))
+	}
+
+	flashBootloader := true
+	ctx := context{flashBootloader: &flashBootloader, bootloaderFirmware: bootloaderFirmware, sysupgradeFirmware: sysupgradeFirmware,
+		board: board, transport: "tftp", serverAddr: "127.0.0.1", ipAddr: "127.0.0.2"}
+	if ctx.recipe, err = loadRecipe(filepath.Join("recipes", board.recipe)); err != nil {
+		t.Fatal(err)
+	}
+	flags := stagePolicyFlags{}
+	for _, policy := range policies {
+		if err := flags.Set(policy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := runPolicy{}
+	for name, override := range flags {
+		policy.merge(name, override)
+	}
+	if err := policy.apply(ctx.recipe); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateRecipe(ctx.recipe, ctx); err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+// flashSimBoard runs the MPU flash flow against a simulated board with the given faults, dir holds the images
+func flashSimBoard(t *testing.T, dir, faults string, policies ...string) (*simBoard, context, error) {
+	startSimTFTP(t)
+	ctx := simTestContext(t, dir, policies...)
+
+	// the boot log and the transcripts are written to the working directory
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	// every run starts a new report, the backup directory included
+	report = &runReport{Started: time.Now()}
+
+	exp, _, err, port := serialSpawn(simulatedPortPrefix+faults, 10*time.Second, expect.CheckDuration(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+	defer exp.Close()
+	board := port.(*simBoard)
+	_, err = FlashFirmwareAndBootlader(exp, ctx, jobsui.NewUI())
+	return board, ctx, err
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "mpu_flash_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// checkFlashed compares the simulated flash with the images
+func checkFlashed(t *testing.T, board *simBoard, ctx context) {
+	flash := ctx.board.flash
+	for _, image := range []struct {
+		name string
+		addr int64
+	}{{ctx.board.images.bootloader, flash.bootloaderAddr}, {ctx.board.images.sysupgrade, flash.firmwareAddr}} {
+		content, err := ioutil.ReadFile(servedFilePath(image.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := board.flash[image.addr-flash.bootloaderAddr:][:len(content)]
+		if !bytes.Equal(written, content) {
+			t.Errorf("%s not written at %s", image.name, hexAddr(image.addr))
+		}
+	}
+}
+
+func TestFlashSimBoard(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	board, ctx, err := flashSimBoard(t, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlashed(t, board, ctx)
+	if board.savedEnv["board"] != ctx.board.envName {
+		t.Errorf("board variable %q, expected %q", board.savedEnv["board"], ctx.board.envName)
+	}
+}
+
+func TestFlashSimBoardTftpDrop(t *testing.T) {
+	// both drops hit the bootloader transfer, its third attempt goes through
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	board, ctx, err := flashSimBoard(t, dir, "tftp-drop=2", "bootloader_load:retries=2,timeout=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlashed(t, board, ctx)
+}
+
+func TestFlashSimBoardFlip(t *testing.T) {
+	// every copy of the bootloader is corrupted, the retries of the write stage included
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	_, _, err := flashSimBoard(t, dir, "flip=3")
+	if err == nil || !strings.Contains(err.Error(), "verification failed") {
+		t.Fatalf("expected a CRC32 verification failure, got %v", err)
+	}
+}
+
+func TestFlashSimBoardHang(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	// the first crc32 checks ART before anything is written
+	board, _, err := flashSimBoard(t, dir, "hang=crc32", "art_fingerprint:timeout=2,retries=0")
+	if err == nil || !strings.Contains(err.Error(), "crc32") {
+		t.Fatalf("expected a timeout on crc32, got %v", err)
+	}
+	if board.firmwareSize != 0 {
+		t.Error("firmware written after the timeout")
+	}
+	// a board just started holds the flash the run found
+	fresh, err := newSimBoard("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	if !bytes.Equal(board.flash, fresh.flash) {
+		t.Error("flash modified after the timeout")
+	}
+}
+
+func TestFlashSimBoardPingFail(t *testing.T) {
+	// ping fails once, the network stage gives up at once and the images go over the console
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	board, ctx, err := flashSimBoard(t, dir, "ping-fail", "bootloader_network:retries=0,timeout=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFlashed(t, board, ctx)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRunRetries are the extra runs of the whole MPU flash after a failure
+	defaultRunRetries = 3
+	// policyAllStages names every stage in a policy
+	policyAllStages = "*"
+	mebibyte        = 1024 * 1024
+)
+
+// stagePolicy overrides the retries, backoff and timeouts of recipe stages, unset fields keep the recipe values
+type stagePolicy struct {
+	Retries      *int `json:"retries,omitempty"`
+	Backoff      *int `json:"backoff,omitempty"`
+	Timeout      *int `json:"timeout,omitempty"`
+	TimeoutPerMB *int `json:"timeout_per_mb,omitempty"`
+}
+
+// runPolicy is read from the policy file and the command line, flags applied last win
+type runPolicy struct {
+	// Retries are the extra runs of the whole MPU flash, nil for defaultRunRetries
+	Retries *int `json:"retries,omitempty"`
+	// Stages are keyed by stage name, "*" applies to every stage before the named policies
+	Stages map[string]stagePolicy `json:"stages,omitempty"`
+}
+
+// loadRunPolicy reads a JSON policy file
+func loadRunPolicy(path string) (runPolicy, error) {
+	policy := runPolicy{}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return policy, errors.Wrap(err, "Read policy file")
+	}
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return policy, errors.Wrapf(err, "Parse policy file %s", path)
+	}
+	return policy, nil
+}
+
+// runRetries returns the extra runs of the whole MPU flash
+func (p runPolicy) runRetries() int {
+	if p.Retries == nil {
+		return defaultRunRetries
+	}
+	return *p.Retries
+}
+
+// merge sets the stage fields given in the override
+func (p *runPolicy) merge(name string, override stagePolicy) {
+	if p.Stages == nil {
+		p.Stages = map[string]stagePolicy{}
+	}
+	merged := p.Stages[name]
+	if override.Retries != nil {
+		merged.Retries = override.Retries
+	}
+	if override.Backoff != nil {
+		merged.Backoff = override.Backoff
+	}
+	if override.Timeout != nil {
+		merged.Timeout = override.Timeout
+	}
+	if override.TimeoutPerMB != nil {
+		merged.TimeoutPerMB = override.TimeoutPerMB
+	}
+	p.Stages[name] = merged
+}
+
+// apply overrides the stages of the recipes, every named stage must exist in one of them
+func (p runPolicy) apply(recipes ...*flashRecipe) error {
+	names := []string{}
+	for name := range p.Stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		found := name == policyAllStages
+		for _, recipe := range recipes {
+			for i := range recipe.Stages {
+				found = found || recipe.Stages[i].Name == name
+			}
+		}
+		if !found {
+			return errors.Errorf("policy for unknown stage %s", name)
+		}
+	}
+	for _, recipe := range recipes {
+		for i := range recipe.Stages {
+			stage := &recipe.Stages[i]
+			for _, name := range []string{policyAllStages, stage.Name} {
+				if policy, ok := p.Stages[name]; ok {
+					policy.applyTo(stage)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s stagePolicy) applyTo(stage *recipeStage) {
+	if s.Retries != nil {
+		stage.Retries = *s.Retries
+	}
+	if s.Backoff != nil {
+		stage.Backoff = *s.Backoff
+	}
+	if s.Timeout != nil {
+		stage.Timeout = *s.Timeout
+	}
+	if s.TimeoutPerMB != nil {
+		stage.TimeoutPerMB = *s.TimeoutPerMB
+	}
+}
+
+// stagePolicyFlags collects the stage policies given on the command line as stage:field=value[,field=value]
+type stagePolicyFlags map[string]stagePolicy
+
+func (f stagePolicyFlags) String() string {
+	values := []string{}
+	for name := range f {
+		values = append(values, name)
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+func (f stagePolicyFlags) Set(value string) error {
+	fields := strings.SplitN(value, ":", 2)
+	if len(fields) != 2 || fields[0] == "" {
+		return errors.Errorf("expected stage:field=value[,field=value], got %q", value)
+	}
+	policy := f[fields[0]]
+	for _, setting := range strings.Split(fields[1], ",") {
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("expected field=value, got %q", setting)
+		}
+		number, err := strconv.Atoi(parts[1])
+		if err != nil || number < 0 {
+			return errors.Errorf("%s must be a non negative number of seconds or retries, got %q", parts[0], parts[1])
+		}
+		switch parts[0] {
+		case "retries":
+			policy.Retries = &number
+		case "backoff":
+			policy.Backoff = &number
+		case "timeout":
+			policy.Timeout = &number
+		case "timeout_per_mb":
+			policy.TimeoutPerMB = &number
+		default:
+			return errors.Errorf("unknown policy field %s, use retries, backoff, timeout or timeout_per_mb", parts[0])
+		}
+	}
+	f[fields[0]] = policy
+	return nil
+}
+
+// stageTimeout returns the stage timeout, lengthened by timeout_per_mb for every started MB of the stage image
+func stageTimeout(stage recipeStage, ctx *context) time.Duration {
+	seconds := int64(stage.Timeout)
+	if size := imageEnv(stage, ctx)["filesize"]; stage.TimeoutPerMB > 0 && size > 0 {
+		seconds += int64(stage.TimeoutPerMB) * ((size + mebibyte - 1) / mebibyte)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// retryDelay returns the pause before the given retry, the backoff doubles after each retry
+func retryDelay(stage recipeStage, retry int) time.Duration {
+	if stage.Backoff <= 0 {
+		return 0
+	}
+	return time.Duration(stage.Backoff<<uint(retry)) * time.Second
+}
+
+// logPolicies logs the effective policy of every stage, timeouts included
+func logPolicies(recipe *flashRecipe, ctx *context) {
+	for _, stage := range recipe.Stages {
+		log.Debugf("Recipe %s stage %s: timeout %s, %d retries, backoff %ds", recipe.Name, stage.Name, stageTimeout(stage, ctx), stage.Retries, stage.Backoff)
+	}
+}
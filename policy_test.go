@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStagePolicyFlagsSet(t *testing.T) {
+	tests := []struct {
+		values []string
+		stage  string
+		policy string
+		err    string
+	}{
+		{[]string{"sysupgrade_write:retries=4"}, "sysupgrade_write", "retries=4", ""},
+		{[]string{"network:timeout=20,backoff=0"}, "network", "backoff=0 timeout=20", ""},
+		{[]string{"*:timeout_per_mb=8"}, "*", "timeout_per_mb=8", ""},
+		{[]string{"network:retries=1", "network:timeout=5,retries=2"}, "network", "retries=2 timeout=5", ""},
+		{[]string{"network"}, "", "", "expected stage:field=value"},
+		{[]string{":retries=1"}, "", "", "expected stage:field=value"},
+		{[]string{"network:retries"}, "", "", "expected field=value"},
+		{[]string{"network:retries=-1"}, "", "", "non negative"},
+		{[]string{"network:timeout=10s"}, "", "", "non negative"},
+		{[]string{"network:delay=1"}, "", "", "unknown policy field delay"},
+	}
+	for _, test := range tests {
+		flags := stagePolicyFlags{}
+		var err error
+		for _, value := range test.values {
+			if err = flags.Set(value); err != nil {
+				break
+			}
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected %q, got %v", test.values, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.values, err)
+			continue
+		}
+		if policy := formatStagePolicy(flags[test.stage]); policy != test.policy {
+			t.Errorf("%q: got %q, expected %q", test.values, policy, test.policy)
+		}
+	}
+}
+
+// formatStagePolicy lists the fields set in the policy, sorted
+func formatStagePolicy(policy stagePolicy) string {
+	fields := []string{}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{{"backoff", policy.Backoff}, {"retries", policy.Retries}, {"timeout", policy.Timeout}, {"timeout_per_mb", policy.TimeoutPerMB}} {
+		if field.value != nil {
+			fields = append(fields, field.name+"="+strconv.Itoa(*field.value))
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func TestStageTimeout(t *testing.T) {
+	ctx := &context{board: &boardProfiles[0]}
+	tests := []struct {
+		name     string
+		stage    recipeStage
+		size     int64
+		expected time.Duration
+	}{
+		{"no image", recipeStage{Timeout: 10, TimeoutPerMB: 5}, 0, 10 * time.Second},
+		{"no per MB term", recipeStage{Timeout: 90, Image: "sysupgrade"}, 10 * mebibyte, 90 * time.Second},
+		{"one byte", recipeStage{Timeout: 90, TimeoutPerMB: 5, Image: "sysupgrade"}, 1, 95 * time.Second},
+		{"exact MB", recipeStage{Timeout: 90, TimeoutPerMB: 5, Image: "sysupgrade"}, 2 * mebibyte, 100 * time.Second},
+		{"started MB", recipeStage{Timeout: 90, TimeoutPerMB: 5, Image: "sysupgrade"}, 2*mebibyte + 1, 105 * time.Second},
+		{"bootloader", recipeStage{Timeout: 30, TimeoutPerMB: 10, Image: "bootloader"}, 0x40000, 40 * time.Second},
+	}
+	for _, test := range tests {
+		ctx.bootloaderFirmware = firmwareFile{size: test.size}
+		ctx.sysupgradeFirmware = firmwareFile{size: test.size}
+		if timeout := stageTimeout(test.stage, ctx); timeout != test.expected {
+			t.Errorf("%s: got %s, expected %s", test.name, timeout, test.expected)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.bug.st/serial.v1/enumerator"
+)
+
+// portCandidate is a serial port listed in the USB database for the selected board
+type portCandidate struct {
+	port   *enumerator.PortDetails
+	device *usbDevice
+}
+
+func (c portCandidate) String() string {
+	description := c.port.Name + " (" + c.device.Name
+	if c.port.SerialNumber != "" {
+		description += ", serial number " + c.port.SerialNumber
+	}
+	return description + ")"
+}
+
+// portSelector picks the board to flash and pins it for the whole run
+type portSelector struct {
+	// serialNumber is given by the user or pinned after the first selection
+	serialNumber string
+	// portName is given by the user, it is only used until a serial number is pinned since names change on reset
+	portName string
+	// choose is called when several boards match, it returns the index of the chosen candidate
+	choose func(candidates []portCandidate) (int, error)
+}
+
+// selectPort filters the candidates and pins the serial number of the chosen board
+func (s *portSelector) selectPort(candidates []portCandidate) (portCandidate, error) {
+	matching := []portCandidate{}
+	for _, candidate := range candidates {
+		if s.serialNumber != "" {
+			if !strings.EqualFold(candidate.port.SerialNumber, s.serialNumber) {
+				continue
+			}
+		} else if s.portName != "" && candidate.port.Name != s.portName {
+			continue
+		}
+		matching = append(matching, candidate)
+	}
+
+	if len(matching) == 0 {
+		switch {
+		case s.serialNumber != "":
+			return portCandidate{}, errors.Errorf("No board with serial number %s", s.serialNumber)
+		case s.portName != "":
+			return portCandidate{}, errors.Errorf("No suitable board on port %s", s.portName)
+		}
+		return portCandidate{}, errors.New("No serial port suitable for upload")
+	}
+
+	chosen := matching[0]
+	if len(matching) > 1 {
+		if s.choose == nil {
+			return portCandidate{}, errors.Errorf("%d boards found, select one with --serial-number or --port", len(matching))
+		}
+		index, err := s.choose(matching)
+		if err != nil {
+			return portCandidate{}, err
+		}
+		chosen = matching[index]
+	}
+
+	if s.serialNumber == "" && chosen.port.SerialNumber != "" {
+		s.serialNumber = chosen.port.SerialNumber
+		log.Infof("Pinning board with serial number %s for this run", s.serialNumber)
+	}
+	return chosen, nil
+}
+
+// resolve returns the current name of the pinned board port, [fallback] is returned if the board
+// cannot be found by serial number, e.g. while the bootloader (which has no serial number) is running
+func (s *portSelector) resolve(fallback string) string {
+	if s.serialNumber == "" {
+		return fallback
+	}
+	ports, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return fallback
+	}
+	for _, port := range ports {
+		if port.IsUSB && strings.EqualFold(port.SerialNumber, s.serialNumber) {
+			if port.Name != fallback {
+				log.Infof("Pinned board moved from %s to %s", fallback, port.Name)
+			}
+			return port.Name
+		}
+	}
+	return fallback
+}
+
+// chooseCandidate lists the candidates on the status line and reads the chosen number
+func chooseCandidate(ask func(question string) string) func([]portCandidate) (int, error) {
+	return func(candidates []portCandidate) (int, error) {
+		choices := []string{}
+		for i, candidate := range candidates {
+			choices = append(choices, fmt.Sprintf("%d) %s", i+1, candidate))
+		}
+		answer := ask("Several boards found: " + strings.Join(choices, " ") + ". Type the board number and press Enter")
+		index, err := strconv.Atoi(strings.TrimSpace(answer))
+		if err != nil || index < 1 || index > len(candidates) {
+			return 0, errors.Errorf("invalid board choice %q", answer)
+		}
+		return index - 1, nil
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// flashRecipe describes the U-Boot console procedure used to flash a board
+type flashRecipe struct {
+	Name   string        `json:"name"`
+	Stages []recipeStage `json:"stages"`
+}
+
+// recipeStage is a batch of steps run with a single timeout, retried as a whole
+type recipeStage struct {
+	Name string `json:"name"`
+	// Job is the UI job set to Error when the stage fails
+	Job string `json:"job,omitempty"`
+	// Done marks Job done when the stage succeeds and skipped when the stage does not run
+	Done bool `json:"done,omitempty"`
+	// DoneInfo is shown next to the job marked done, e.g. the verified flash range
+	DoneInfo string `json:"done_info,omitempty"`
+	// When lists "a == b" or "a != b" conditions, joined with "&&" if needed, the stage runs if any of them holds,
+	// always if empty
+	When []string `json:"when,omitempty"`
+	// Image binds the image.* variables to the bootloader or sysupgrade image
+	Image string `json:"image,omitempty"`
+	// Timeout in seconds applies to every expected pattern, TimeoutPerMB adds seconds per MiB of the stage image
+	Timeout      int `json:"timeout"`
+	TimeoutPerMB int `json:"timeout_per_mb,omitempty"`
+	// Retries is the number of extra attempts, OnRetry names the hook run after each failed attempt
+	Retries int    `json:"retries,omitempty"`
+	OnRetry string `json:"on_retry,omitempty"`
+	// Backoff is the pause in seconds before the first retry, doubled before each following one
+	Backoff int `json:"backoff,omitempty"`
+	// Optional stages do not abort the recipe on failure
+	Optional bool `json:"optional,omitempty"`
+	// Status, StatusDone and StatusFailed are shown in the UI status line
+	Status       string `json:"status,omitempty"`
+	StatusDone   string `json:"status_done,omitempty"`
+	StatusFailed string `json:"status_failed,omitempty"`
+	// State is saved to the run state file once the stage succeeds, see runStates
+	State string `json:"state,omitempty"`
+	// Set assigns variables once the stage succeeds, SetFailed once an optional stage fails
+	Set       map[string]string `json:"set,omitempty"`
+	SetFailed map[string]string `json:"set_failed,omitempty"`
+	Steps     []recipeStep      `json:"steps"`
+}
+
+// recipeStep either sends a line, expects a pattern, pauses, checks a condition, shows a message or calls a hook
+type recipeStep struct {
+	// Send is written to the console followed by a newline
+	Send *string `json:"send,omitempty"`
+	// Expect is a regular expression waited for on the console
+	Expect string `json:"expect,omitempty"`
+	// Capture stores submatches of Expect into variables, index -1 takes the last non empty submatch
+	Capture map[string]int `json:"capture,omitempty"`
+	// Sleep pauses for the given seconds before the next step
+	Sleep int `json:"sleep,omitempty"`
+	// Check is a condition evaluated once the previous steps ran, the stage fails with the Fail message if it does not hold
+	Check string `json:"check,omitempty"`
+	Fail  string `json:"fail,omitempty"`
+	// Show is displayed in the UI status line once the previous steps ran
+	Show string `json:"show,omitempty"`
+	// Call runs the named recipe hook once the previous steps ran
+	Call string `json:"call,omitempty"`
+	// When skips the step unless the condition holds, it sees the variables captured before the last check, show or call
+	When string `json:"when,omitempty"`
+}
+
+var (
+	recipeVariable  = regexp.MustCompile(`\{\{\s*([a-zA-Z0-9_.]+)\s*\}\}`)
+	recipeCondition = regexp.MustCompile(`^(.*?)\s*(==|!=)\s*(.*)$`)
+	recipeImages    = []string{"bootloader", "sysupgrade"}
+)
+
+// loadRecipe reads a JSON recipe, it must be validated against the board variables before use
+func loadRecipe(path string) (*flashRecipe, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read flash recipe")
+	}
+	recipe := &flashRecipe{}
+	if err := json.Unmarshal(content, recipe); err != nil {
+		return nil, errors.Wrapf(err, "Parse flash recipe %s", path)
+	}
+	return recipe, nil
+}
+
+// expandVariables replaces every {{name}} with its value, unknown names are an error
+func expandVariables(text string, vars map[string]string) (string, error) {
+	var err error
+	expanded := recipeVariable.ReplaceAllStringFunc(text, func(match string) string {
+		name := recipeVariable.FindStringSubmatch(match)[1]
+		value, ok := vars[name]
+		if !ok && err == nil {
+			err = errors.Errorf("unknown variable %s", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// evalCondition expands and evaluates "a == b" or "a != b" conditions joined with "&&"
+func evalCondition(condition string, vars map[string]string) (bool, error) {
+	holds := true
+	for _, part := range strings.Split(condition, "&&") {
+		partHolds, err := evalComparison(part, vars)
+		if err != nil {
+			return false, err
+		}
+		holds = holds && partHolds
+	}
+	return holds, nil
+}
+
+func evalComparison(condition string, vars map[string]string) (bool, error) {
+	match := recipeCondition.FindStringSubmatch(strings.TrimSpace(condition))
+	if match == nil {
+		return false, errors.Errorf("invalid condition %q", condition)
+	}
+	left, err := expandVariables(match[1], vars)
+	if err != nil {
+		return false, err
+	}
+	right, err := expandVariables(match[3], vars)
+	if err != nil {
+		return false, err
+	}
+	return (strings.TrimSpace(left) == strings.TrimSpace(right)) == (match[2] == "=="), nil
+}
+
+// bindImage returns the variables with image.* pointing to the stage image
+func bindImage(image string, vars map[string]string) map[string]string {
+	if image == "" {
+		return vars
+	}
+	bound := map[string]string{}
+	for name, value := range vars {
+		bound[name] = value
+		if strings.HasPrefix(name, image+".") {
+			bound["image."+strings.TrimPrefix(name, image+".")] = value
+		}
+	}
+	return bound
+}
+
+// validate checks the recipe against the given variables, values only need to be representative.
+// Every variable must be known or set by an earlier stage, every pattern must compile and every
+// capture must refer to an existing submatch.
+func (r *flashRecipe) validate(vars map[string]string, jobs []string) error {
+	if len(r.Stages) == 0 {
+		return errors.Errorf("recipe %s has no stages", r.Name)
+	}
+	known := map[string]string{}
+	for name, value := range vars {
+		known[name] = value
+	}
+	for _, stage := range r.Stages {
+		if err := stage.validate(known, jobs); err != nil {
+			return errors.Wrapf(err, "recipe %s, stage %s", r.Name, stage.Name)
+		}
+	}
+	return nil
+}
+
+func (s *recipeStage) validate(known map[string]string, jobs []string) error {
+	if s.Timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	if _, err := expandVariables(s.Status, bindImage(s.Image, known)); err != nil {
+		return errors.Wrap(err, "status")
+	}
+	if s.Retries < 0 || s.Backoff < 0 || s.TimeoutPerMB < 0 {
+		return errors.New("retries, backoff and timeout_per_mb must not be negative")
+	}
+	if s.TimeoutPerMB > 0 && s.Image == "" {
+		return errors.New("timeout_per_mb needs a stage image")
+	}
+	if s.OnRetry != "" {
+		if _, ok := recipeHooks[s.OnRetry]; !ok {
+			return errors.Errorf("unknown hook %s", s.OnRetry)
+		}
+	}
+	if s.Job != "" && !containsString(jobs, s.Job) {
+		return errors.Errorf("unknown job %s", s.Job)
+	}
+	if s.Image != "" && !containsString(recipeImages, s.Image) {
+		return errors.Errorf("unknown image %s", s.Image)
+	}
+	for _, condition := range s.When {
+		if _, err := evalCondition(condition, known); err != nil {
+			return err
+		}
+	}
+	if s.State != "" && !containsString(runStates, s.State) {
+		return errors.Errorf("unknown state %s", s.State)
+	}
+	if s.DoneInfo != "" && !s.Done {
+		return errors.New("done_info without done")
+	}
+
+	// captured variables are available to checks, messages and later stages,
+	// the other steps of a stage are expanded up front
+	vars := bindImage(s.Image, known)
+	captured := []string{}
+	withCaptures := func() map[string]string {
+		all := bindImage(s.Image, known)
+		for _, name := range captured {
+			all[name] = ""
+		}
+		return all
+	}
+	for i, step := range s.Steps {
+		count := 0
+		if step.When != "" {
+			if _, err := evalCondition(step.When, withCaptures()); err != nil {
+				return errors.Wrapf(err, "step %d", i+1)
+			}
+		}
+		if step.Send != nil {
+			count++
+			if _, err := expandVariables(*step.Send, vars); err != nil {
+				return errors.Wrapf(err, "step %d", i+1)
+			}
+		}
+		if step.Expect != "" {
+			count++
+			pattern, err := expandVariables(step.Expect, vars)
+			if err != nil {
+				return errors.Wrapf(err, "step %d", i+1)
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.Wrapf(err, "step %d", i+1)
+			}
+			for name, group := range step.Capture {
+				if group < -1 || group > re.NumSubexp() {
+					return errors.Errorf("step %d: capture %s refers to missing submatch %d", i+1, name, group)
+				}
+				captured = append(captured, name)
+			}
+		} else if len(step.Capture) > 0 {
+			return errors.Errorf("step %d: capture without expect", i+1)
+		}
+		if step.Sleep > 0 {
+			count++
+		}
+		if step.Check != "" {
+			count++
+			if _, err := evalCondition(step.Check, withCaptures()); err != nil {
+				return errors.Wrapf(err, "step %d", i+1)
+			}
+			if _, err := expandVariables(step.Fail, withCaptures()); err != nil {
+				return errors.Wrapf(err, "step %d", i+1)
+			}
+		} else if step.Fail != "" {
+			return errors.Errorf("step %d: fail without check", i+1)
+		}
+		if step.Show != "" {
+			count++
+			if _, err := expandVariables(step.Show, withCaptures()); err != nil {
+				return errors.Wrapf(err, "step %d", i+1)
+			}
+		}
+		if step.Call != "" {
+			count++
+			if _, ok := recipeHooks[step.Call]; !ok {
+				return errors.Errorf("step %d: unknown hook %s", i+1, step.Call)
+			}
+		}
+		if count != 1 {
+			return errors.Errorf("step %d must have exactly one of send, expect, sleep, check, show or call", i+1)
+		}
+	}
+	for _, name := range captured {
+		known[name] = ""
+		vars[name] = ""
+	}
+	if len(s.SetFailed) > 0 && !s.Optional {
+		return errors.New("set_failed without optional")
+	}
+	for _, set := range []map[string]string{s.Set, s.SetFailed} {
+		for name, value := range set {
+			if _, err := expandVariables(value, vars); err != nil {
+				return err
+			}
+			known[name] = ""
+		}
+	}
+	if _, err := expandVariables(s.DoneInfo, vars); err != nil {
+		return errors.Wrap(err, "done_info")
+	}
+	if _, err := expandVariables(s.StatusDone, vars); err != nil {
+		return errors.Wrap(err, "status_done")
+	}
+	return nil
+}
+
+// captureValue returns the requested submatch, -1 takes the last non empty one
+func captureValue(match []string, group int) string {
+	if group >= 0 {
+		return match[group]
+	}
+	for i := len(match) - 1; i > 0; i-- {
+		if match[i] != "" {
+			return match[i]
+		}
+	}
+	return ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// imageVariables describes an image and the flash partition it is written to
+func imageVariables(prefix string, image firmwareFile, partAddr, partSize int64, flash flashLayout) map[string]string {
+	return map[string]string{
+		prefix + ".name":         image.name,
+		prefix + ".size":         strconv.FormatInt(image.size, 10),
+		prefix + ".size_hex":     hexAddr(image.size),
+		prefix + ".sectors":      strconv.FormatInt(flash.sectors(image.size), 10),
+		prefix + ".crc32":        image.crc32,
+		prefix + ".version":      image.version,
+		prefix + ".md5":          image.md5,
+		prefix + ".addr":         hexAddr(partAddr),
+		prefix + ".part_size":    hexAddr(partSize),
+		prefix + ".part_sectors": strconv.FormatInt(flash.sectors(partSize), 10),
+	}
+}
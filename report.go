@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const reportFileName = "updater_report.json"
+
+// imageReport identifies an image written to the board
+type imageReport struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+// runReport collects the outcome of the run, it is saved next to the log file
+type runReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Board    string    `json:"board,omitempty"`
+	// SerialNumber is the USB serial number of the board pinned for the run
+	SerialNumber string `json:"serial_number,omitempty"`
+	// MAC is the board MAC address read from ART, it identifies the board across runs
+	MAC string `json:"mac,omitempty"`
+	// ResumedFrom is the last state confirmed by an interrupted run this run continued
+	ResumedFrom string `json:"resumed_from,omitempty"`
+	// Mode is linux when the board was updated with sysupgrade from its Linux shell
+	Mode       string        `json:"mode,omitempty"`
+	Sketch     *imageReport  `json:"sketch,omitempty"`
+	Sysupgrade *imageReport  `json:"sysupgrade,omitempty"`
+	Backup     *backupReport `json:"backup,omitempty"`
+	// EnvDiff lists the U-Boot environment changes caused by flashing the bootloader
+	EnvDiff []string `json:"env_diff,omitempty"`
+	// Uboot is the bootloader found on the board before flashing
+	Uboot *ubootFingerprint `json:"uboot,omitempty"`
+	// Transcript is the serial session recording
+	Transcript string `json:"transcript,omitempty"`
+	// Boot is the Linux system checked after flashing
+	Boot  *bootReport `json:"boot,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+var report = &runReport{Started: time.Now()}
+
+// save writes the report as indented JSON, failures are only logged since the report is informative
+func (r *runReport) save() {
+	r.Finished = time.Now()
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(reportFileName, content, 0666)
+	}
+	if err != nil {
+		log.Errorf("Unable to save run report: %s", err.Error())
+	}
+}
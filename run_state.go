@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const runStateFileName = "updater_state.json"
+
+// the run states, in order, each one is only saved once the board confirmed it
+const (
+	stateTerminalFlashed   = "terminal_flashed"
+	stateBootloaderFlashed = "bootloader_flashed"
+	stateImageFlashed      = "image_flashed"
+	stateMcuFinal          = "mcu_final"
+)
+
+var runStates = []string{stateTerminalFlashed, stateBootloaderFlashed, stateImageFlashed, stateMcuFinal}
+
+// runState is the progress of an update, saved after every state so that a later run or a retry
+// continues from the last confirmed one
+type runState struct {
+	Board        string `json:"board"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	// Images identifies the images being written, a run with other images starts over
+	Images  map[string]string `json:"images"`
+	Reached []string          `json:"reached"`
+	Updated time.Time         `json:"updated"`
+	// checkpoint is where a retry in the same process continues
+	checkpoint *runCheckpoint
+}
+
+// runCheckpoint is the recipe run as it was after the stage confirming the last state
+type runCheckpoint struct {
+	run    *recipeRun
+	recipe *flashRecipe
+	// next is the index of the first stage left to run
+	next int
+}
+
+// newRunState returns the state of a run flashing the given images from the start
+func newRunState(board string, images map[string]string) *runState {
+	return &runState{Board: board, Images: images, Reached: []string{}}
+}
+
+// loadRunState returns the saved state if it belongs to an unfinished run of the same board and images,
+// a fresh state otherwise
+func loadRunState(board string, images map[string]string) *runState {
+	fresh := newRunState(board, images)
+	content, err := ioutil.ReadFile(runStateFileName)
+	if os.IsNotExist(err) {
+		return fresh
+	}
+	saved := &runState{}
+	if err == nil {
+		err = json.Unmarshal(content, saved)
+	}
+	switch {
+	case err != nil:
+		log.Warnf("Ignoring unreadable %s: %s", runStateFileName, err.Error())
+		return fresh
+	case saved.Board != board:
+		log.Infof("Saved run state is for board %s, starting over", saved.Board)
+		return fresh
+	case saved.reached(stateMcuFinal):
+		return fresh
+	}
+	for name, checksum := range images {
+		if saved.Images[name] != checksum {
+			log.Infof("Saved run state is for another %s image, starting over", name)
+			return fresh
+		}
+	}
+	if last := saved.last(); last != "" {
+		log.Infof("Resuming the run of %s from state %s", saved.Updated.Format(time.RFC3339), last)
+	}
+	return saved
+}
+
+// reached returns true if the state was confirmed, a nil state has none
+func (s *runState) reached(state string) bool {
+	return s != nil && containsString(s.Reached, state)
+}
+
+// last returns the latest confirmed state, empty if none
+func (s *runState) last() string {
+	if s == nil || len(s.Reached) == 0 {
+		return ""
+	}
+	return s.Reached[len(s.Reached)-1]
+}
+
+// pin ties the state to the board serial number, a saved state of another board is dropped
+func (s *runState) pin(serialNumber string) {
+	if s == nil || serialNumber == "" {
+		return
+	}
+	if s.SerialNumber != "" && s.SerialNumber != serialNumber {
+		log.Infof("Saved run state is for board %s, starting over", s.SerialNumber)
+		s.Reached = []string{}
+	}
+	s.SerialNumber = serialNumber
+}
+
+// reach records the state and saves it, failures are only logged since the run goes on
+func (s *runState) reach(state string) {
+	if s == nil || s.reached(state) {
+		return
+	}
+	s.Reached = append(s.Reached, state)
+	s.save()
+	log.Infof("Run state %s saved", state)
+}
+
+func (s *runState) save() {
+	s.Updated = time.Now()
+	content, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(runStateFileName, content, 0644)
+	}
+	if err != nil {
+		log.Errorf("Unable to save run state: %s", errors.Wrap(err, runStateFileName).Error())
+	}
+}
+
+// rewind drops the state and the following ones, when the board shows they no longer hold
+func (s *runState) rewind(state string) {
+	if s == nil {
+		return
+	}
+	for i, reached := range s.Reached {
+		if reached == state {
+			s.Reached = s.Reached[:i]
+			s.checkpoint = nil
+			log.Infof("Run state rewound before %s", state)
+			s.save()
+			return
+		}
+	}
+}
+
+// resume returns the checkpoint run if its U-Boot shell still answers, so that a retry does not reboot
+// the board, nil otherwise
+func (s *runState) resume(ctx context) *runCheckpoint {
+	if s == nil || s.checkpoint == nil {
+		return nil
+	}
+	checkpoint := s.checkpoint
+	s.checkpoint = nil
+	run := checkpoint.run
+	if checkpoint.next >= len(checkpoint.recipe.Stages) || run.vars["shell"] == "" {
+		return nil
+	}
+	if _, err := run.command("", 5*time.Second); err != nil {
+		log.Infof("U-Boot shell not answering, running recipe %s from the start", checkpoint.recipe.Name)
+		return nil
+	}
+	// the retry may use other addresses
+	run.ctx.serverAddr, run.ctx.ipAddr = ctx.serverAddr, ctx.ipAddr
+	run.vars["serverip"], run.vars["ipaddr"] = ctx.serverAddr, ctx.ipAddr
+	log.Infof("Resuming recipe %s at stage %s", checkpoint.recipe.Name, checkpoint.recipe.Stages[checkpoint.next].Name)
+	return checkpoint
+}
+
+// linuxReleaseCurrent returns true if the board runs Linux with the release of the sysupgrade image,
+// it re-checks a run resumed after the image was flashed
+func (r *recipeRun) linuxReleaseCurrent() bool {
+	if _, err := r.linuxCommand("", 5*time.Second); err != nil {
+		log.Infof("No Linux shell to check the flashed image: %s", err.Error())
+		return false
+	}
+	output, err := r.linuxCommand("cat /etc/openwrt_release", 5*time.Second)
+	if err != nil {
+		return false
+	}
+	release := parseRelease(output)
+	output, _ = r.linuxCommand("uname -a", 5*time.Second)
+	kernel := ""
+	if match := unamePattern.FindStringSubmatch(output); match != nil {
+		kernel = match[1]
+	}
+	version := r.ctx.sysupgradeFirmware.version
+	log.Infof("Board runs %q (kernel %s), image %q", release, kernel, version)
+	return bootMatchesImage(version, release, kernel)
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	expect "github.com/facchinm/goexpect"
+	jobsui "github.com/mic90/go-jobs-ui"
+	"github.com/pin/tftp"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// simulatedPortPrefix is the serialSpawn port name of the simulated board, followed by the faults to inject
+	simulatedPortPrefix = "sim:"
+	simRAMAddr          = 0x80000000
+	simRAMSize          = 0x2000000
+	simMAC              = "90:a2:da:f0:12:34"
+	simLinuxPrompt      = "root@Arduino:~# "
+	// simAutobootDelay is how long the simulated bootloader waits for the stop word
+	simAutobootDelay = 2 * time.Second
+)
+
+// simFaultNames are the faults the simulated board can inject, each given as name or name=count
+var simFaultNames = []string{
+	// tftp-drop times out the tftp transfer
+	"tftp-drop",
+	// tftp-size loses the last byte of a tftp transfer
+	"tftp-size",
+	// ping-fail answers ping with host not alive
+	"ping-fail",
+	// flip corrupts a byte written by cp.b
+	"flip",
+	// hang=COMMAND swallows the command without ever answering
+	"hang",
+}
+
+// simFaults counts the remaining occurrences of each fault, hang also names the command
+type simFaults struct {
+	counts      map[string]int
+	hangCommand string
+}
+
+// parseSimFaults reads a comma separated fault list such as "tftp-drop=2,flip,hang=crc32"
+func parseSimFaults(spec string) (simFaults, error) {
+	faults := simFaults{counts: map[string]int{}}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			name, value = item[:i], item[i+1:]
+		}
+		if !containsString(simFaultNames, name) {
+			return faults, errors.Errorf("unknown fault %q, use %s", name, strings.Join(simFaultNames, ", "))
+		}
+		count := 1
+		switch {
+		case name == "hang":
+			if value == "" {
+				return faults, errors.New("hang needs a command, e.g. hang=crc32")
+			}
+			faults.hangCommand = value
+		case value != "":
+			var err error
+			if count, err = strconv.Atoi(value); err != nil || count < 1 {
+				return faults, errors.Errorf("invalid count in %q", item)
+			}
+		}
+		faults.counts[name] = count
+	}
+	return faults, nil
+}
+
+// simBoard emulates a Yun behind the serial terminal sketch: the sketch speed commands, the Linux shell,
+// the bootloader with its environment and an in-memory NOR flash and RAM. It implements the port side of
+// serialSpawn, tftp fetches the images from the updater TFTP server over loopback.
+type simBoard struct {
+	layout flashLayout
+	uboot  ubootProfile
+	flash  []byte
+	ram    []byte
+	// env is the running environment, savedEnv the one in flash, nil once erased
+	env      bootEnv
+	savedEnv bootEnv
+	// firmwareSize is the length of the image last copied to the firmware partition
+	firmwareSize int64
+	faults       simFaults
+
+	input  chan byte
+	tilde  bool
+	output *io.PipeWriter
+	reader *io.PipeReader
+	closed chan struct{}
+	once   sync.Once
+}
+
+// newSimBoard starts a simulated board running an old firmware, with the given faults
+func newSimBoard(faultSpec string) (*simBoard, error) {
+	faults, err := parseSimFaults(faultSpec)
+	if err != nil {
+		return nil, err
+	}
+	profile := boardProfiles[0]
+	b := &simBoard{
+		layout: profile.flash,
+		uboot:  profile.uboot,
+		flash:  bytes.Repeat([]byte{0xff}, int(profile.flash.size)),
+		ram:    make([]byte, simRAMSize),
+		faults: faults,
+		input:  make(chan byte, 1<<20),
+		closed: make(chan struct{}),
+	}
+	// an older bootloader and the calibration data starting with the MAC address
+	for i := int64(0); i < 0x20000; i++ {
+		b.flash[i] = byte(i * 7)
+	}
+	art := b.layout.protected[0].addr - b.layout.bootloaderAddr
+	for i := int64(0); i < 0x1000; i++ {
+		b.flash[art+i] = byte(i ^ 0x5a)
+	}
+	mac, _ := parseMAC(simMAC)
+	copy(b.flash[art:], mac)
+	b.savedEnv = b.defaultEnv()
+	b.savedEnv["ethaddr"] = simMAC
+	b.env = b.copyEnv(b.savedEnv)
+	b.reader, b.output = io.Pipe()
+	log.Infof("Simulated board started, faults %q", faultSpec)
+	go b.run()
+	return b, nil
+}
+
+func parseMAC(mac string) ([]byte, error) {
+	parts := strings.Split(mac, ":")
+	data := make([]byte, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return nil, err
+		}
+		data[i] = byte(value)
+	}
+	return data, nil
+}
+
+func (b *simBoard) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+// Write handles the sketch "~" commands like the serial terminal sketch and passes the rest to the board
+func (b *simBoard) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if b.tilde {
+			b.tilde = false
+			for _, speed := range terminalSpeeds {
+				if speed.key == string(c) {
+					go b.print("Speed set to %d\r\n", speed.baudRate)
+				}
+			}
+			if strings.IndexByte(terminalEscapeKeys, c) >= 0 {
+				continue
+			}
+			b.feed('~')
+		} else if c == '~' {
+			b.tilde = true
+			continue
+		}
+		b.feed(c)
+	}
+	return len(p), nil
+}
+
+func (b *simBoard) feed(c byte) {
+	select {
+	case b.input <- c:
+	case <-b.closed:
+	}
+}
+
+func (b *simBoard) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+		b.output.Close()
+	})
+	return nil
+}
+
+func (b *simBoard) print(format string, args ...interface{}) {
+	fmt.Fprintf(b.output, format, args...)
+}
+
+// readLine returns the next line typed on the console, echoing it, or false on timeout or close
+func (b *simBoard) readLine(timeout time.Duration) (string, bool) {
+	line := []byte{}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	for {
+		select {
+		case c := <-b.input:
+			switch c {
+			case '\r':
+			case '\n':
+				b.print("\r\n")
+				return string(line), true
+			default:
+				line = append(line, c)
+				b.output.Write([]byte{c})
+			}
+		case <-expired:
+			return string(line), false
+		case <-b.closed:
+			return "", false
+		}
+	}
+}
+
+// run starts in the Linux shell, then moves between bootloader and Linux until closed
+func (b *simBoard) run() {
+	state := b.linux
+	for state != nil {
+		state = state()
+	}
+}
+
+type simState func() simState
+
+func (b *simBoard) boot() simState {
+	if bytes.Equal(b.flash[:4], []byte{0xff, 0xff, 0xff, 0xff}) {
+		// erased bootloader, the board is bricked
+		log.Warn("Simulated board: no bootloader in flash, nothing boots")
+		<-b.closed
+		return nil
+	}
+	b.env = b.copyEnv(b.savedEnv)
+	if b.env == nil {
+		b.env = b.defaultEnv()
+	}
+	b.print("\r\n\r\nU-Boot 1.1.4-arduino (Oct 19 2026 - 10:00:00)\r\n\r\nDRAM:  64 MB\r\nFlash: 16 MB\r\n")
+	b.print("autoboot in 1 seconds (type '%s' to enter u-boot console)...\r\n", b.uboot.stopWord)
+	typed := ""
+	deadline := time.Now().Add(simAutobootDelay)
+	for time.Now().Before(deadline) && !strings.Contains(typed, b.uboot.stopWord) {
+		line, ok := b.readLine(time.Until(deadline))
+		typed += line
+		if !ok && len(line) == 0 {
+			break
+		}
+	}
+	if strings.Contains(typed, b.uboot.stopWord) {
+		return b.bootloader
+	}
+	return b.bootLinux
+}
+
+func (b *simBoard) bootLinux() simState {
+	b.print("## Booting image at 9f050000 ...\r\nTransferring control to Linux (at address 80060000) ...\r\n")
+	b.print("[    0.000000] Linux version 4.4.61 (builder@buildhost)\r\n")
+	image, err := parseSysupgradeImage(b.flash[b.layout.firmwareAddr-b.layout.bootloaderAddr:][:b.firmwareSize])
+	if err != nil {
+		b.print("[    1.234567] VFS: Cannot open root device \"mtdblock2\"\r\n[    1.234600] Kernel panic - not syncing: VFS: Unable to mount root fs on unknown-block(31,2)\r\n")
+		b.print("[    1.234700] Rebooting in 1 seconds..\r\n")
+		<-b.closed
+		return nil
+	}
+	b.print("[    2.000000] VFS: Mounted root (squashfs filesystem) readonly on device 31:2.\r\n")
+	b.print("\r\nPlease press Enter to activate this console.\r\n")
+	for {
+		line, ok := b.readLine(0)
+		if !ok {
+			return nil
+		}
+		if line == "" {
+			return b.linuxShell(image)
+		}
+	}
+}
+
+func (b *simBoard) linux() simState {
+	// the board runs the firmware it came with
+	return b.linuxShell(&sysupgradeImage{kernelName: "MIPS OpenWrt Linux-3.3.8", version: "OpenWrt 1.5.3 r1"})
+}
+
+func (b *simBoard) linuxShell(image *sysupgradeImage) simState {
+	release := strings.Fields(image.version)
+	for len(release) < 3 {
+		release = append(release, "")
+	}
+	kernel := image.kernelName[strings.LastIndex(image.kernelName, "Linux-")+len("Linux-"):]
+	for {
+		b.print(simLinuxPrompt)
+		line, ok := b.readLine(0)
+		if !ok {
+			return nil
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "reboot":
+			b.print("[  100.000000] reboot: Restarting system\r\n")
+			return b.boot
+		case line == "cat /proc/mtd":
+			b.print("dev:    size   erasesize  name\r\nmtd0: %08x %08x \"u-boot\"\r\nmtd1: %08x %08x \"u-boot-env\"\r\nmtd2: %08x %08x \"firmware\"\r\nmtd3: %08x %08x \"art\"\r\n",
+				b.layout.bootloaderSize, b.layout.sectorSize, b.layout.envSize, b.layout.sectorSize, b.layout.firmwareSize, b.layout.sectorSize, b.layout.protected[0].size, b.layout.sectorSize)
+		case len(fields) == 6 && fields[0] == "head" && fields[3] == "/dev/mtd0" && fields[5] == "md5sum":
+			size, _ := strconv.ParseInt(fields[2], 10, 64)
+			b.print("%x  -\r\n", md5.Sum(b.flash[:size]))
+		case line == "cat /etc/openwrt_release":
+			b.print("DISTRIB_ID='%s'\r\nDISTRIB_RELEASE='%s'\r\nDISTRIB_REVISION='%s'\r\n", release[0], release[1], release[2])
+		case line == "uname -a":
+			b.print("Linux Arduino %s #1 Thu Oct 19 10:00:00 2026 mips GNU/Linux\r\n", kernel)
+		case line == "df":
+			b.print("Filesystem           1K-blocks      Used Available Use%% Mounted on\r\nrootfs                    7232       440      6792   6%% /\r\n")
+		default:
+			b.print("-ash: %s: not found\r\n", fields[0])
+		}
+	}
+}
+
+func (b *simBoard) bootloader() simState {
+	for {
+		b.print("%s> ", b.uboot.shell)
+		line, ok := b.readLine(0)
+		if !ok {
+			return nil
+		}
+		fields := b.expand(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if b.faults.hangCommand != "" && fields[0] == b.faults.hangCommand && b.fault("hang") {
+			log.Infof("Simulated board: hanging on %q", line)
+			<-b.closed
+			return nil
+		}
+		if fields[0] == "reset" {
+			return b.boot
+		}
+		if err := b.command(fields); err != nil {
+			b.print("%s\r\n", err.Error())
+		}
+	}
+}
+
+// fault returns true if the fault is to be injected now
+func (b *simBoard) fault(name string) bool {
+	if b.faults.counts[name] == 0 {
+		return false
+	}
+	b.faults.counts[name]--
+	log.Infof("Simulated board: injecting %s", name)
+	return true
+}
+
+// command runs a bootloader command, the returned error is printed like U-Boot does
+func (b *simBoard) command(fields []string) error {
+	args := fields[1:]
+	switch fields[0] {
+	case "help":
+		for _, command := range []string{"cp", "crc32", "erase", "flinfo", "help", "loadb", "md", "ping", "printenv", "reset", "saveenv", "setenv", "tftpboot", "version"} {
+			b.print("%-10s- simulated %s\r\n", command, command)
+		}
+	case "version":
+		b.print("U-Boot 1.1.4-arduino (Oct 19 2026 - 10:00:00)\r\n")
+	case "flinfo":
+		b.print("Bank # 1: Flash size: %d MB, sector size %d KB\r\n", b.layout.size>>20, b.layout.sectorSize>>10)
+	case "printenv":
+		b.printenv(args)
+	case "setenv":
+		if len(args) == 0 {
+			return errors.New("Usage: setenv name value")
+		}
+		if len(args) == 1 {
+			delete(b.env, args[0])
+		} else {
+			b.env[args[0]] = strings.Join(args[1:], " ")
+		}
+	case "saveenv":
+		b.savedEnv = b.copyEnv(b.env)
+		b.print("Saving Environment to Flash...\r\nErasing Flash... done\r\nWriting to Flash... done\r\n")
+	case "ping":
+		if len(args) != 1 || b.fault("ping-fail") || args[0] != b.env["serverip"] {
+			b.print("ping failed; host %s is not alive\r\n", strings.Join(args, " "))
+		} else {
+			b.print("host %s is alive\r\n", args[0])
+		}
+	case "tftp", "tftpboot":
+		return b.tftp(args)
+	case "loadb":
+		return b.loadb(args)
+	case "crc32":
+		addr, size, err := b.addrSize(args, 0)
+		if err != nil {
+			return err
+		}
+		data, err := b.memory(addr, size)
+		if err != nil {
+			return err
+		}
+		b.print("CRC32 for %08x ... %08x ==> %08x\r\n", addr, addr+size-1, crc32.ChecksumIEEE(data))
+	case "md.b":
+		addr, size, err := b.addrSize(args, 0)
+		if err != nil {
+			return err
+		}
+		data, err := b.memory(addr, size)
+		if err != nil {
+			return err
+		}
+		for offset := int64(0); offset < size; offset += 16 {
+			line := data[offset:]
+			if len(line) > 16 {
+				line = line[:16]
+			}
+			hexBytes := ""
+			for _, c := range line {
+				hexBytes += fmt.Sprintf(" %02x", c)
+			}
+			b.print("%08x:%s\r\n", addr+offset, hexBytes)
+		}
+	case "erase":
+		if len(args) != 2 || !strings.HasPrefix(args[1], "+") {
+			return errors.New("Usage: erase start +len")
+		}
+		addr, size, err := b.addrSize([]string{args[0], strings.TrimPrefix(args[1], "+")}, 0)
+		if err != nil {
+			return err
+		}
+		sectors := (size + b.layout.sectorSize - 1) / b.layout.sectorSize
+		data, err := b.memory(addr, sectors*b.layout.sectorSize)
+		if err != nil || addr < b.layout.bootloaderAddr {
+			return errors.New("Error: erase outside of flash")
+		}
+		for i := range data {
+			data[i] = 0xff
+		}
+		if addr <= b.layout.envAddr && addr+int64(len(data)) > b.layout.envAddr {
+			b.savedEnv = nil
+		}
+		if addr == b.layout.firmwareAddr {
+			b.firmwareSize = 0
+		}
+		b.print("Erasing flash... %s done\r\nErased %d sectors\r\n", strings.Repeat(".", int(sectors)), sectors)
+	case "cp.b":
+		return b.copy(args)
+	default:
+		return errors.Errorf("Unknown command '%s' - try 'help'", fields[0])
+	}
+	return nil
+}
+
+// tftp fetches the file from the serverip TFTP server into RAM and sets fileaddr and filesize
+func (b *simBoard) tftp(args []string) error {
+	if len(args) != 2 {
+		return errors.New("Usage: tftp loadAddress filename")
+	}
+	addr, err := parseSimNumber(args[0])
+	if err != nil {
+		return err
+	}
+	b.print("Using eth0 device\r\nTFTP from server %s; our IP address is %s\r\nFilename '%s'.\r\nLoad address: 0x%x\r\nLoading: ", b.env["serverip"], b.env["ipaddr"], args[1], addr)
+	if b.fault("tftp-drop") {
+		b.print("T T T T T T T T T T \r\nRetry count exceeded; starting again\r\n")
+		return errors.New("Abort")
+	}
+	client, err := tftp.NewClient(net.JoinHostPort(b.env["serverip"], tftpPort()))
+	if err != nil {
+		return err
+	}
+	client.SetTimeout(2 * time.Second)
+	receiver, err := client.Receive(args[1], "octet")
+	if err != nil {
+		b.print("\r\nTFTP error: '%s'\r\n", err.Error())
+		return errors.New("Starting again")
+	}
+	content := bytes.Buffer{}
+	if _, err := receiver.WriteTo(&content); err != nil {
+		return err
+	}
+	data := content.Bytes()
+	if b.fault("tftp-size") {
+		data = data[:len(data)-1]
+	}
+	ram, err := b.memory(addr, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	copy(ram, data)
+	b.print("%s\r\ndone\r\nBytes transferred = %d (%x hex)\r\n", strings.Repeat("#", len(data)/0x10000+1), len(data), len(data))
+	b.env["fileaddr"] = fmt.Sprintf("%x", addr)
+	b.env["filesize"] = fmt.Sprintf("%x", len(data))
+	return nil
+}
+
+// loadb receives a file with Kermit into RAM, acknowledging every packet, the updater sets fileaddr and filesize
+func (b *simBoard) loadb(args []string) error {
+	addr := b.layout.loadAddr
+	if len(args) > 0 {
+		var err error
+		if addr, err = parseSimNumber(args[0]); err != nil {
+			return err
+		}
+	}
+	b.print("## Ready for binary (kermit) download to 0x%08X at 115200 bps...\r\n", addr)
+	content := []byte{}
+	for {
+		seq, kind, data, ok := b.readKermitPacket()
+		if !ok {
+			return errors.New("## Binary (kermit) download aborted")
+		}
+		b.output.Write(kermitPacket(seq, 'Y', nil))
+		switch kind {
+		case 'D':
+			content = append(content, kermitDecode(data)...)
+		case 'B':
+			ram, err := b.memory(addr, int64(len(content)))
+			if err != nil {
+				return err
+			}
+			copy(ram, content)
+			b.print("## Total Size      = 0x%08x = %d Bytes\r\n## Start Addr      = 0x%08X\r\n", len(content), len(content), addr)
+			return nil
+		}
+	}
+}
+
+// readKermitPacket returns the next packet with a valid block check, packets with a bad one are refused
+func (b *simBoard) readKermitPacket() (int, byte, []byte, bool) {
+	next := func() (byte, bool) {
+		select {
+		case c := <-b.input:
+			return c, true
+		case <-b.closed:
+			return 0, false
+		}
+	}
+	for {
+		c, ok := next()
+		if !ok {
+			return 0, 0, nil, false
+		}
+		if c != kermitSOH {
+			continue
+		}
+		length, ok := next()
+		if !ok {
+			return 0, 0, nil, false
+		}
+		// sequence, type, data and block check, then the end of line
+		packet := make([]byte, int(length)-32+1)
+		for i := range packet {
+			if packet[i], ok = next(); !ok {
+				return 0, 0, nil, false
+			}
+		}
+		seq, kind, data := int(packet[0])-32, packet[1], packet[2:len(packet)-2]
+		expected := kermitPacket(seq, kind, data)
+		if expected[len(expected)-2] != packet[len(packet)-2] {
+			b.output.Write(kermitPacket(seq, 'N', nil))
+			continue
+		}
+		return seq, kind, data, true
+	}
+}
+
+// kermitDecode removes the prefixes added by kermitEncode
+func kermitDecode(data []byte) []byte {
+	decoded := []byte{}
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c == kermitQuote && i+1 < len(data) {
+			i++
+			c = data[i]
+			if x := c & 0x7f; x >= 0x3f && x <= 0x5f {
+				c ^= 0x40
+			}
+		}
+		decoded = append(decoded, c)
+	}
+	return decoded
+}
+
+// copy copies RAM to flash with NOR semantics, bits can only be cleared
+func (b *simBoard) copy(args []string) error {
+	if len(args) != 3 {
+		return errors.New("Usage: cp.b source target count")
+	}
+	src, err := parseSimNumber(args[0])
+	if err != nil {
+		return err
+	}
+	dst, size, err := b.addrSize(args[1:], 0)
+	if err != nil {
+		return err
+	}
+	from, err := b.memory(src, size)
+	if err != nil {
+		return err
+	}
+	to, err := b.memory(dst, size)
+	if err != nil {
+		return err
+	}
+	for i := range to {
+		to[i] &= from[i]
+	}
+	if b.fault("flip") && size > 0 {
+		to[size/2] ^= 0x10
+	}
+	if dst == b.layout.firmwareAddr {
+		b.firmwareSize = size
+	}
+	b.print("Copy to Flash... write addr: %08x\r\ndone\r\n", dst)
+	return nil
+}
+
+func (b *simBoard) printenv(names []string) {
+	if len(names) == 0 {
+		names = b.env.names()
+		for _, name := range names {
+			b.print("%s=%s\r\n", name, b.env[name])
+		}
+		b.print("\r\nEnvironment size: %d/%d bytes\r\n", len(b.env.String()), b.layout.envSize-4)
+		return
+	}
+	for _, name := range names {
+		if value, ok := b.env[name]; ok {
+			b.print("%s=%s\r\n", name, value)
+		} else {
+			b.print("## Error: \"%s\" not defined\r\n", name)
+		}
+	}
+}
+
+// expand splits the command line, replacing $name and ${name} with the environment and honouring "\" escapes
+func (b *simBoard) expand(line string) []string {
+	fields := []string{}
+	field := ""
+	inField := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			i++
+			field += string(line[i])
+			inField = true
+		case c == '$':
+			j := i + 1
+			braced := j < len(line) && line[j] == '{'
+			if braced {
+				j++
+			}
+			k := j
+			for k < len(line) && envNamePattern.MatchString(line[k:k+1]) {
+				k++
+			}
+			field += b.env[line[j:k]]
+			if braced && k < len(line) && line[k] == '}' {
+				k++
+			}
+			i = k - 1
+			inField = true
+		case c == ' ' || c == '\t':
+			if inField {
+				fields = append(fields, field)
+			}
+			field, inField = "", false
+		default:
+			field += string(c)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// addrSize parses the address and size arguments at index i, hexadecimal like in U-Boot
+func (b *simBoard) addrSize(args []string, i int) (int64, int64, error) {
+	if len(args) < i+2 {
+		return 0, 0, errors.New("Usage: address size")
+	}
+	addr, err := parseSimNumber(args[i])
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := parseSimNumber(args[i+1])
+	return addr, size, err
+}
+
+func parseSimNumber(value string) (int64, error) {
+	number, err := strconv.ParseInt(strings.TrimPrefix(value, "0x"), 16, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid number %q", value)
+	}
+	return number, nil
+}
+
+// memory returns the flash or RAM bytes at the address
+func (b *simBoard) memory(addr, size int64) ([]byte, error) {
+	switch {
+	case addr >= b.layout.bootloaderAddr && addr+size <= b.layout.bootloaderAddr+b.layout.size:
+		return b.flash[addr-b.layout.bootloaderAddr:][:size], nil
+	case addr >= simRAMAddr && addr+size <= simRAMAddr+simRAMSize:
+		return b.ram[addr-simRAMAddr:][:size], nil
+	}
+	return nil, errors.Errorf("Error: %08x +%x is not mapped", addr, size)
+}
+
+// defaultEnv is the environment compiled into the simulated bootloader
+func (b *simBoard) defaultEnv() bootEnv {
+	return bootEnv{
+		"bootcmd":   "bootm 0x9f050000",
+		"bootdelay": "1",
+		"baudrate":  "115200",
+		"ipaddr":    "192.168.1.1",
+		"serverip":  "192.168.1.2",
+	}
+}
+
+func (b *simBoard) copyEnv(env bootEnv) bootEnv {
+	if env == nil {
+		return nil
+	}
+	copied := bootEnv{}
+	for name, value := range env {
+		copied[name] = value
+	}
+	return copied
+}
+
+// simulationFaultHelp lists the faults for the command line help
+func simulationFaultHelp() string {
+	names := append([]string{}, simFaultNames...)
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// runSimulation runs the MPU flash flow against the simulated board, through the TFTP server and the
+// serial expecter like with a real board
+func runSimulation(ui *jobsui.UI, ctx context, faults string) {
+	ui.AddJob("startTftp", "Start TFTP server")
+	ui.AddJob("checkBridge", "Check MCU serial bridge")
+	ui.AddJob("backupFlash", "Back up MPU flash")
+	ui.AddJob("flashBootloader", "Flash MPU bootloader")
+	ui.AddJob("flashImage", "Flash MPU linux image")
+
+	if err := ServeTFTP(); err != nil {
+		ui.SetJobStateWithInfo("startTftp", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, "unable to start TFTP server")
+	}
+	ui.SetJobState("startTftp", jobsui.Done)
+	ctx.serverAddr = "127.0.0.1"
+	ctx.ipAddr = "127.0.0.2"
+
+	exp, _, err, board := serialSpawn(simulatedPortPrefix+faults, 10*time.Second, expect.CheckDuration(100*time.Millisecond))
+	if err != nil {
+		ui.SetJobStateWithInfo("checkBridge", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	if err := CheckSerialBridge(exp); err != nil {
+		ui.SetJobStateWithInfo("checkBridge", jobsui.Error, err.Error())
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	ui.SetJobStateWithInfo("checkBridge", jobsui.Done, "simulated board")
+
+	_, err = FlashFirmwareAndBootlader(exp, ctx, ui)
+	for retry := 0; err != nil && retry < ctx.retries; retry++ {
+		ui.SetStatus("Firmware upload failed, retrying")
+		log.Errorf("Simulated firmware upload attempt %d/%d failed: %s", retry+1, ctx.retries+1, err.Error())
+		_, err = FlashFirmwareAndBootlader(exp, ctx, ui)
+	}
+	exp.Close()
+	board.Close()
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, "simulation failed: "+err.Error())
+	}
+	report.save()
+	ui.SetStatus("Simulation done, see updater.log. You may now close the window, or wait 10s")
+	time.Sleep(10 * time.Second)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	uImageMagic      = 0x27051956
+	uImageHeaderSize = 64
+	uImageOsLinux    = 5
+	uImageArchMips   = 5
+	uImageTypeKernel = 2
+
+	fwtoolMagic       = 0x46577830
+	fwtoolTrailerSize = 16
+	fwtoolTypeInfo    = 1
+)
+
+// squashfsMagic is "hsqs", the little endian squashfs superblock magic
+var squashfsMagic = []byte("hsqs")
+
+// sysupgradeImage is what the updater knows about a sysupgrade image after parsing it
+type sysupgradeImage struct {
+	// kernelName is the uImage name, e.g. "MIPS LEDE Linux-4.4.61"
+	kernelName     string
+	kernelLoadAddr int64
+	kernelSize     int64
+	// rootfsOffset is the offset of the squashfs superblock from the start of the image
+	rootfsOffset int64
+	// devices and version come from the fwtool metadata, they are empty for images without it
+	devices []string
+	version string
+}
+
+// fwtoolMetadata is the JSON block appended by fwtool to LEDE/OpenWrt images
+type fwtoolMetadata struct {
+	SupportedDevices []string `json:"supported_devices"`
+	Version          struct {
+		Dist     string `json:"dist"`
+		Version  string `json:"version"`
+		Revision string `json:"revision"`
+		Board    string `json:"board"`
+	} `json:"version"`
+}
+
+// parseSysupgradeImage checks the uImage kernel header, looks for the squashfs root filesystem
+// after the kernel and reads the fwtool metadata trailer if present
+func parseSysupgradeImage(content []byte) (*sysupgradeImage, error) {
+	if len(content) < uImageHeaderSize {
+		return nil, errors.New("too short for a uImage header")
+	}
+	header := make([]byte, uImageHeaderSize)
+	copy(header, content)
+	if binary.BigEndian.Uint32(header[0:]) != uImageMagic {
+		return nil, errors.New("no uImage kernel header")
+	}
+	headerCrc := binary.BigEndian.Uint32(header[4:])
+	binary.BigEndian.PutUint32(header[4:], 0)
+	if crc32.ChecksumIEEE(header) != headerCrc {
+		return nil, errors.New("uImage header CRC mismatch")
+	}
+
+	image := &sysupgradeImage{
+		kernelName:     strings.TrimRight(string(header[32:]), "\x00"),
+		kernelLoadAddr: int64(binary.BigEndian.Uint32(header[16:])),
+		kernelSize:     int64(binary.BigEndian.Uint32(header[12:])),
+	}
+	if header[28] != uImageOsLinux || header[29] != uImageArchMips || header[30] != uImageTypeKernel {
+		return nil, errors.Errorf("uImage %q is not a MIPS Linux kernel", image.kernelName)
+	}
+	kernelEnd := uImageHeaderSize + image.kernelSize
+	if kernelEnd > int64(len(content)) {
+		return nil, errors.Errorf("uImage kernel is %d bytes, image is truncated", image.kernelSize)
+	}
+	if crc32.ChecksumIEEE(content[uImageHeaderSize:kernelEnd]) != binary.BigEndian.Uint32(header[24:]) {
+		return nil, errors.New("uImage kernel data CRC mismatch")
+	}
+
+	// the root filesystem starts on a 4 bytes boundary after the kernel, usually an erase block
+	offset := kernelEnd
+	for ; offset+int64(len(squashfsMagic)) <= int64(len(content)); offset += 4 {
+		if bytes.Equal(content[offset:offset+int64(len(squashfsMagic))], squashfsMagic) {
+			break
+		}
+	}
+	if offset+int64(len(squashfsMagic)) > int64(len(content)) {
+		return nil, errors.New("no squashfs root filesystem after the kernel")
+	}
+	image.rootfsOffset = offset
+
+	metadata, err := readFwtoolMetadata(content)
+	if err != nil {
+		return nil, err
+	}
+	if metadata != nil {
+		image.devices = metadata.SupportedDevices
+		v := metadata.Version
+		image.version = strings.TrimSpace(strings.Join([]string{v.Dist, v.Version, v.Revision}, " "))
+	}
+	return image, nil
+}
+
+// readFwtoolMetadata walks the fwtool blocks from the end of the image, signature blocks are skipped.
+// It returns nil if the image has no metadata.
+func readFwtoolMetadata(content []byte) (*fwtoolMetadata, error) {
+	end := len(content)
+	for end >= fwtoolTrailerSize {
+		trailer := content[end-fwtoolTrailerSize : end]
+		if binary.BigEndian.Uint32(trailer[0:]) != fwtoolMagic {
+			return nil, nil
+		}
+		size := int(binary.BigEndian.Uint32(trailer[12:]))
+		if size < fwtoolTrailerSize || size > end {
+			return nil, errors.New("malformed fwtool trailer")
+		}
+		if trailer[8] == fwtoolTypeInfo {
+			// the block starts with the metadata version and flags words
+			block := content[end-size : end-fwtoolTrailerSize]
+			if len(block) < 8 {
+				return nil, errors.New("malformed fwtool metadata")
+			}
+			metadata := &fwtoolMetadata{}
+			if err := json.Unmarshal(bytes.TrimRight(block[8:], "\x00"), metadata); err != nil {
+				return nil, errors.Wrap(err, "Parse fwtool metadata")
+			}
+			return metadata, nil
+		}
+		end -= size
+	}
+	return nil, nil
+}
+
+// checkSysupgradeImage rejects images meant for other devices or too big for the board firmware partition
+func checkSysupgradeImage(image *sysupgradeImage, size int64, board *boardProfile) error {
+	if size > board.flash.firmwareSize {
+		return errors.Errorf("image is %d bytes, %s firmware partition has room for %d bytes", size, board.name, board.flash.firmwareSize)
+	}
+	if image.kernelLoadAddr != board.flash.kernelLoadAddr {
+		return errors.Errorf("kernel load address %s, %s boots kernels at %s", hexAddr(image.kernelLoadAddr), board.name, hexAddr(board.flash.kernelLoadAddr))
+	}
+	if len(image.devices) == 0 {
+		return nil
+	}
+	for _, device := range image.devices {
+		if containsString(board.images.sysupgradeDevices, device) {
+			return nil
+		}
+	}
+	return errors.Errorf("image supports %s, not %s", strings.Join(image.devices, ", "), board.name)
+}
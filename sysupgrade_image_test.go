@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestParseSysupgradeImage(t *testing.T) {
+	board := &boardProfiles[0]
+	valid := testSysupgradeImage(board)
+	trailer := len(valid) - fwtoolTrailerSize
+	modified := func(change func(image []byte) []byte) []byte {
+		return change(append([]byte{}, valid...))
+	}
+
+	tests := []struct {
+		name    string
+		image   []byte
+		err     string
+		version string
+	}{
+		{"valid", valid, "", "LEDE 17.01.4 r3560"},
+		{"no metadata", valid[:trailer], "", ""},
+		{"short", valid[:uImageHeaderSize-1], "too short", ""},
+		{"magic", modified(func(image []byte) []byte { image[0] = 0; return image }), "no uImage kernel header", ""},
+		{"header crc", modified(func(image []byte) []byte { image[32] = 'X'; return image }), "header CRC mismatch", ""},
+		{"data crc", modified(func(image []byte) []byte { image[uImageHeaderSize] ^= 1; return image }), "data CRC mismatch", ""},
+		{"truncated", valid[:uImageHeaderSize+0x100], "truncated", ""},
+		{"trailer size", modified(func(image []byte) []byte {
+			binary.BigEndian.PutUint32(image[trailer+12:], fwtoolTrailerSize-1)
+			return image
+		}), "malformed fwtool trailer", ""},
+		{"metadata", modified(func(image []byte) []byte {
+			binary.BigEndian.PutUint32(image[trailer+12:], fwtoolTrailerSize+4)
+			return image
+		}), "malformed fwtool metadata", ""},
+	}
+	for _, test := range tests {
+		image, err := parseSysupgradeImage(test.image)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if image.version != test.version || image.kernelLoadAddr != board.flash.kernelLoadAddr {
+			t.Errorf("%s: version %q at %s", test.name, image.version, hexAddr(image.kernelLoadAddr))
+		}
+	}
+}
+
+func TestCheckSysupgradeImage(t *testing.T) {
+	board := &boardProfiles[0]
+	tests := []struct {
+		name    string
+		size    int64
+		addr    int64
+		devices []string
+		err     string
+	}{
+		{"supported", 0x100000, board.flash.kernelLoadAddr, board.images.sysupgradeDevices, ""},
+		{"no metadata", 0x100000, board.flash.kernelLoadAddr, nil, ""},
+		{"partition size", board.flash.firmwareSize, board.flash.kernelLoadAddr, nil, ""},
+		{"too big", board.flash.firmwareSize + 1, board.flash.kernelLoadAddr, nil, "has room for"},
+		{"load address", 0x100000, board.flash.kernelLoadAddr + 0x1000, nil, "kernel load address"},
+		{"other device", 0x100000, board.flash.kernelLoadAddr, []string{"tl-wr1043nd"}, "image supports tl-wr1043nd"},
+	}
+	for _, test := range tests {
+		image := &sysupgradeImage{kernelLoadAddr: test.addr, devices: test.devices}
+		err := checkSysupgradeImage(image, test.size, board)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+	}
+}
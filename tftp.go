@@ -2,8 +2,11 @@ package main
 
 import (
 	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/pin/tftp"
@@ -11,13 +14,90 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const port = ":69"
+// tftpAddr is where the TFTP server listens, after ServeTFTP a ":0" port is replaced by the one picked
+var tftpAddr = ":69"
 
-// readHandler is called when client starts file download from server
-func readHandler(filename string, rf io.ReaderFrom) error {
+// uploadDir receives the files sent by the board with tftpput, uploads are refused while it is empty
+// and only the expected names are accepted from the board address
+var uploadDir struct {
+	sync.Mutex
+	path  string
+	host  string
+	names map[string]bool
+}
+
+// servedFiles are served in addition to the tftp directory, e.g. backups being restored
+var servedFiles struct {
+	sync.Mutex
+	paths map[string]string
+}
+
+// serveFile serves the file at path under the given name, an empty path stops serving it
+func serveFile(name, path string) {
+	servedFiles.Lock()
+	defer servedFiles.Unlock()
+	if servedFiles.paths == nil {
+		servedFiles.paths = map[string]string{}
+	}
+	if path == "" {
+		delete(servedFiles.paths, name)
+	} else {
+		servedFiles.paths[name] = path
+	}
+}
+
+// setUploadDir enables uploads of the named files from host into the given directory, an empty path disables them
+func setUploadDir(path, host string, names ...string) {
+	uploadDir.Lock()
+	defer uploadDir.Unlock()
+	uploadDir.path = path
+	uploadDir.host = host
+	uploadDir.names = map[string]bool{}
+	for _, name := range names {
+		uploadDir.names[name] = true
+	}
+}
+
+// uploadAllowed returns the directory receiving the file, or an error if the upload is not expected
+func uploadAllowed(filename string, wt io.WriterTo) (string, error) {
+	uploadDir.Lock()
+	defer uploadDir.Unlock()
+	if uploadDir.path == "" {
+		return "", errors.New("uploads are disabled")
+	}
+	if !uploadDir.names[filename] {
+		return "", errors.Errorf("unexpected upload %s", filename)
+	}
+	// a replayed upload has no remote address
+	if transfer, ok := wt.(tftp.IncomingTransfer); ok {
+		addr := transfer.RemoteAddr()
+		if !addr.IP.Equal(net.ParseIP(uploadDir.host)) {
+			return "", errors.Errorf("upload of %s from %s, expected from %s", filename, addr.IP, uploadDir.host)
+		}
+	}
+	return uploadDir.path, nil
+}
+
+// tftpFilePath returns the path of a file of the tftp directory next to the executable
+func tftpFilePath(filename string) string {
 	execDir, _ := os.Executable()
 	execDir = filepath.Dir(execDir)
-	file, err := os.Open(filepath.Join(execDir, "tftp", filename))
+	return filepath.Join(execDir, "tftp", filepath.Base(filename))
+}
+
+// servedFilePath returns the path of the file served under the name, from servedFiles or the tftp directory
+func servedFilePath(filename string) string {
+	servedFiles.Lock()
+	defer servedFiles.Unlock()
+	if served, ok := servedFiles.paths[filename]; ok {
+		return served
+	}
+	return tftpFilePath(filename)
+}
+
+// readHandler is called when client starts file download from server
+func readHandler(filename string, rf io.ReaderFrom) error {
+	file, err := os.Open(servedFilePath(filename))
 	if err != nil {
 		log.Errorf("%v\n", err)
 		return err
@@ -31,21 +111,53 @@ func readHandler(filename string, rf io.ReaderFrom) error {
 	return nil
 }
 
-// ServeTFTP stars new tftp server at port 69
+// writeHandler is called when client starts file upload to server
+func writeHandler(filename string, wt io.WriterTo) error {
+	dir, err := uploadAllowed(filename, wt)
+	if err != nil {
+		log.Errorf("Refused upload: %v\n", err)
+		return err
+	}
+	file, err := os.Create(filepath.Join(dir, filename))
+	if err != nil {
+		log.Errorf("%v\n", err)
+		return err
+	}
+	defer file.Close()
+	n, err := wt.WriteTo(file)
+	if err != nil {
+		log.Errorf("%v\n", err)
+		return err
+	}
+	log.Infof("%d bytes received\n", n)
+	if content, err := ioutil.ReadFile(file.Name()); err == nil {
+		recordUpload(filename, content)
+	}
+	return nil
+}
+
+// tftpPort returns the port of the TFTP server
+func tftpPort() string {
+	_, port, _ := net.SplitHostPort(tftpAddr)
+	return port
+}
+
+// ServeTFTP stars new tftp server at tftpAddr, port 69 unless changed
 func ServeTFTP() error {
-	// only read capabilities
-	s := tftp.NewServer(readHandler, nil)
-	s.SetTimeout(5 * time.Second) // optional
-	go func() {
-		time.Sleep(1 * time.Second)
-		s.Shutdown()
-	}()
-	err := s.ListenAndServe(port) // blocks until s.Shutdown() is called
+	addr, err := net.ResolveUDPAddr("udp", tftpAddr)
 	if err != nil {
 		return errors.Wrap(err, "Can't start tftp server")
 	}
-	// respawn as goroutine
-	go s.ListenAndServe(port)
-	log.Infof("Started tftp server at port %s", port)
+	// bind before returning, a port already in use is reported here
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Can't start tftp server")
+	}
+	tftpAddr = conn.LocalAddr().String()
+	// uploads are only accepted while a backup is running
+	s := tftp.NewServer(readHandler, writeHandler)
+	s.SetTimeout(5 * time.Second) // optional
+	go s.Serve(conn)
+	log.Infof("Started tftp server at port %s", tftpPort())
 	return nil
 }
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	expect "github.com/facchinm/goexpect"
+	jobsui "github.com/mic90/go-jobs-ui"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const transcriptDir = "transcripts"
+
+var (
+	// transcriptLinePattern matches "SECONDS < "received"" and "SECONDS > "sent"" lines
+	transcriptLinePattern = regexp.MustCompile(`^([0-9]+\.[0-9]+) ([<>]) (".*")$`)
+	// transcriptFilePattern matches "SECONDS = "name" "content"" lines, the files uploaded by the board
+	transcriptFilePattern = regexp.MustCompile(`^([0-9]+\.[0-9]+) = ("(?:[^"\\]|\\.)*") (".*")$`)
+	serveripPattern       = regexp.MustCompile(`setenv serverip ([0-9.]+)`)
+	ipaddrPattern         = regexp.MustCompile(`setenv ipaddr ([0-9.]+)`)
+	httpURLPattern        = regexp.MustCompile(`http://([0-9.]+):([0-9]+)/`)
+)
+
+// serialRecorder passes the serial port traffic through, writing it with timestamps to a plain text
+// transcript, which the replay driver loads, and to an asciinema v2 recording
+type serialRecorder struct {
+	port  io.ReadWriter
+	start time.Time
+	sync.Mutex
+	text *os.File
+	cast *os.File
+}
+
+// recording is the latest serial recorder still open, the files uploaded by the board go to its transcript
+var recording struct {
+	sync.Mutex
+	recorder *serialRecorder
+}
+
+// newSerialRecorder creates the transcript files of the session in the transcripts directory
+func newSerialRecorder(port io.ReadWriter, portName string) (*serialRecorder, error) {
+	if err := os.MkdirAll(transcriptDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Create transcript directory")
+	}
+	start := time.Now()
+	// spawns in the same millisecond get a counter, an existing transcript is never truncated
+	base := filepath.Join(transcriptDir, "serial-"+start.Format("20060102-150405.000"))
+	text, name, err := createTranscript(base, ".log")
+	if err != nil {
+		return nil, errors.Wrap(err, "Create transcript")
+	}
+	cast, err := os.OpenFile(strings.TrimSuffix(name, ".log")+".cast", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		text.Close()
+		return nil, errors.Wrap(err, "Create transcript")
+	}
+	fmt.Fprintf(text, "# serial transcript of %s started %s, < received, > sent, = uploaded\n", portName, start.Format(time.RFC3339))
+	header, _ := json.Marshal(map[string]interface{}{"version": 2, "width": 120, "height": 40, "timestamp": start.Unix(), "title": "yun-go-updater " + portName})
+	fmt.Fprintf(cast, "%s\n", header)
+	report.Transcript = text.Name()
+	log.Infof("Recording serial session to %s", text.Name())
+	recorder := &serialRecorder{port: port, start: start, text: text, cast: cast}
+	recording.Lock()
+	recording.recorder = recorder
+	recording.Unlock()
+	return recorder, nil
+}
+
+// record writes the data in both formats, asciinema only knows output ("o") and input ("i") events
+func (s *serialRecorder) record(direction string, data []byte) {
+	s.Lock()
+	defer s.Unlock()
+	elapsed := time.Since(s.start).Seconds()
+	fmt.Fprintf(s.text, "%.6f %s %s\n", elapsed, direction, strconv.Quote(string(data)))
+	kind := "o"
+	if direction == ">" {
+		kind = "i"
+	}
+	event, _ := json.Marshal([]interface{}{elapsed, kind, string(data)})
+	fmt.Fprintf(s.cast, "%s\n", event)
+}
+
+func (s *serialRecorder) Read(p []byte) (int, error) {
+	n, err := s.port.Read(p)
+	if n > 0 {
+		s.record("<", p[:n])
+	}
+	return n, err
+}
+
+func (s *serialRecorder) Write(p []byte) (int, error) {
+	s.record(">", p)
+	return s.port.Write(p)
+}
+
+// createTranscript creates base+ext, or base-N+ext for the first N not taken yet
+func createTranscript(base, ext string) (*os.File, string, error) {
+	for n := 1; ; n++ {
+		name := base + ext
+		if n > 1 {
+			name = fmt.Sprintf("%s-%d%s", base, n, ext)
+		}
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return file, name, err
+		}
+	}
+}
+
+// recordUpload adds a file uploaded by the board to the transcript being recorded, a replay hands it out again
+func recordUpload(name string, content []byte) {
+	recording.Lock()
+	s := recording.recorder
+	recording.Unlock()
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	fmt.Fprintf(s.text, "%.6f = %s %s\n", time.Since(s.start).Seconds(), strconv.Quote(name), strconv.Quote(string(content)))
+}
+
+// Close closes the transcript files, not the port
+func (s *serialRecorder) Close() error {
+	recording.Lock()
+	if recording.recorder == s {
+		recording.recorder = nil
+	}
+	recording.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	s.cast.Close()
+	return s.text.Close()
+}
+
+// transcriptEvent is a chunk of data received from (<) or sent to (>) the board, or a file it uploaded (=)
+type transcriptEvent struct {
+	elapsed   float64
+	direction string
+	data      []byte
+	// name is the name of an uploaded file
+	name string
+}
+
+// loadTranscript reads a plain text transcript written by serialRecorder
+func loadTranscript(path string) ([]transcriptEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Open transcript")
+	}
+	defer file.Close()
+	events := []transcriptEvent{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		event := transcriptEvent{}
+		var err error
+		if match := transcriptFilePattern.FindStringSubmatch(text); match != nil {
+			event.elapsed, _ = strconv.ParseFloat(match[1], 64)
+			event.direction = "="
+			event.name, err = strconv.Unquote(match[2])
+			if err == nil {
+				event.data, err = unquoteBytes(match[3])
+			}
+		} else if match := transcriptLinePattern.FindStringSubmatch(text); match != nil {
+			event.elapsed, _ = strconv.ParseFloat(match[1], 64)
+			event.direction = match[2]
+			event.data, err = unquoteBytes(match[3])
+		} else {
+			return nil, errors.Errorf("%s:%d: invalid transcript line", path, line)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, line)
+		}
+		events = append(events, event)
+	}
+	return events, errors.Wrap(scanner.Err(), "Read transcript")
+}
+
+func unquoteBytes(quoted string) ([]byte, error) {
+	data, err := strconv.Unquote(quoted)
+	return []byte(data), err
+}
+
+// replayPort plays a transcript back as the board: received data is handed out up to the next data
+// sent in the recording, and only once the flow has written something in its place. The files uploaded
+// by the board reach the upload directory when the command that sent them is written
+type replayPort struct {
+	sync.Mutex
+	cond   *sync.Cond
+	events []transcriptEvent
+	// sends are the indexes of the sent events, written counts the ones the replayed flow has matched
+	sends   []int
+	written int
+	// next is the event to read, pending the rest of a received event partially read
+	next    int
+	pending []byte
+	closed  bool
+}
+
+func newReplayPort(events []transcriptEvent) *replayPort {
+	port := &replayPort{events: events}
+	for i, event := range events {
+		if event.direction == ">" {
+			port.sends = append(port.sends, i)
+		}
+	}
+	port.cond = sync.NewCond(&port.Mutex)
+	return port
+}
+
+func (p *replayPort) Read(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	for len(p.pending) == 0 {
+		switch {
+		case p.closed || p.next >= len(p.events):
+			return 0, io.EOF
+		case p.events[p.next].direction == "<":
+			p.pending = p.events[p.next].data
+			p.next++
+		case p.events[p.next].direction == "=" || p.written > 0 && p.sends[p.written-1] >= p.next:
+			p.next++
+		default:
+			// the recorded flow sent something here, wait for the replayed flow to do the same
+			p.cond.Wait()
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// Write matches the next sent event, differences with the recording are logged since the replay
+// then goes on with the recorded board output
+func (p *replayPort) Write(b []byte) (int, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.written >= len(p.sends) {
+		log.Warnf("Replay: sent %q after the end of the transcript", b)
+		return len(b), nil
+	}
+	recorded := p.events[p.sends[p.written]]
+	if string(recorded.data) != string(b) {
+		log.Warnf("Replay: sent %q, the recording sent %q at %.3fs", b, recorded.data, recorded.elapsed)
+	}
+	p.written++
+	end := len(p.events)
+	if p.written < len(p.sends) {
+		end = p.sends[p.written]
+	}
+	for _, event := range p.events[p.sends[p.written-1]+1 : end] {
+		if event.direction == "=" {
+			if err := writeHandler(event.name, bytes.NewReader(event.data)); err != nil {
+				log.Warnf("Replay: upload of %s refused: %s", event.name, err.Error())
+			}
+		}
+	}
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+func (p *replayPort) Close() error {
+	p.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.Unlock()
+	return nil
+}
+
+// replayAddresses returns the server and board addresses and the http port used in the recorded session,
+// so that the replayed commands match the recorded ones
+func replayAddresses(events []transcriptEvent) (serverAddr, ipAddr string, httpPort int) {
+	for _, event := range events {
+		if event.direction != ">" {
+			continue
+		}
+		if match := serveripPattern.FindSubmatch(event.data); match != nil {
+			serverAddr = string(match[1])
+		}
+		if match := ipaddrPattern.FindSubmatch(event.data); match != nil {
+			ipAddr = string(match[1])
+		}
+		if match := httpURLPattern.FindSubmatch(event.data); match != nil {
+			serverAddr = string(match[1])
+			httpPort, _ = strconv.Atoi(string(match[2]))
+		}
+	}
+	return serverAddr, ipAddr, httpPort
+}
+
+// replaySpawn returns an expecter talking to the transcript instead of a board, like serialSpawn
+func replaySpawn(events []transcriptEvent, timeout time.Duration, opts ...expect.Option) (expect.Expecter, <-chan error, error) {
+	port := newReplayPort(events)
+	resCh := make(chan error)
+	return expect.SpawnGeneric(&expect.GenOptions{
+		In:  port,
+		Out: port,
+		Wait: func() error {
+			return <-resCh
+		},
+		Close: func() error {
+			close(resCh)
+			return port.Close()
+		},
+		Check: func() bool { return true },
+	}, timeout, opts...)
+}
+
+// runReplay runs the MPU flash flow against a recorded serial session, without touching any hardware
+func runReplay(ui *jobsui.UI, ctx context, path string) {
+	ui.AddJob("backupFlash", "Back up MPU flash")
+	ui.AddJob("flashBootloader", "Flash MPU bootloader")
+	ui.AddJob("flashImage", "Flash MPU linux image")
+
+	events, err := loadTranscript(path)
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	ctx.serverAddr, ctx.ipAddr, ctx.httpPort = replayAddresses(events)
+	log.Infof("Replaying %s: %d events, server %s, board %s", path, len(events), ctx.serverAddr, ctx.ipAddr)
+
+	exp, _, err := replaySpawn(events, 10*time.Second, expect.CheckDuration(100*time.Millisecond))
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, err.Error())
+	}
+	_, err = FlashFirmwareAndBootlader(exp, ctx, ui)
+	exp.Close()
+	if err != nil {
+		log.Error(err)
+		waitForKeyAndExit(ui, "replay failed: "+err.Error())
+	}
+	report.save()
+	ui.SetStatus("Replay done, see updater.log. You may now close the window, or wait 10s")
+	time.Sleep(10 * time.Second)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateTranscript(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		created  string
+	}{
+		{"first", nil, "serial-20180101-120000.000.log"},
+		{"taken", []string{"serial-20180101-120000.000.log"}, "serial-20180101-120000.000-2.log"},
+		{"counter taken", []string{"serial-20180101-120000.000.log", "serial-20180101-120000.000-2.log"}, "serial-20180101-120000.000-3.log"},
+		{"gap", []string{"serial-20180101-120000.000.log", "serial-20180101-120000.000-3.log"}, "serial-20180101-120000.000-2.log"},
+		{"other extension", []string{"serial-20180101-120000.000.cast"}, "serial-20180101-120000.000.log"},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "transcript_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		for _, name := range test.existing {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		file, name, err := createTranscript(filepath.Join(dir, "serial-20180101-120000.000"), ".log")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		file.Close()
+		if name != filepath.Join(dir, test.created) {
+			t.Errorf("%s: created %s, expected %s", test.name, filepath.Base(name), test.created)
+		}
+		// the existing transcripts are left as they were
+		for _, existing := range test.existing {
+			if content, err := ioutil.ReadFile(filepath.Join(dir, existing)); err != nil || string(content) != existing {
+				t.Errorf("%s: %s modified", test.name, existing)
+			}
+		}
+	}
+}
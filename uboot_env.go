@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// bootEnv is the U-Boot environment as printed by printenv
+type bootEnv map[string]string
+
+var (
+	envLinePattern = regexp.MustCompile(`^([A-Za-z0-9_.\-]+)=(.*)$`)
+	envNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+)
+
+// parseBootEnv reads the name=value lines of the printenv output, other lines are ignored
+func parseBootEnv(output string) bootEnv {
+	env := bootEnv{}
+	for _, line := range strings.Split(output, "\n") {
+		if match := envLinePattern.FindStringSubmatch(strings.TrimRight(line, "\r")); match != nil {
+			env[match[1]] = match[2]
+		}
+	}
+	return env
+}
+
+// names returns the sorted variable names
+func (e bootEnv) names() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String formats the environment the way printenv does, sorted by name
+func (e bootEnv) String() string {
+	lines := ""
+	for _, name := range e.names() {
+		lines += name + "=" + e[name] + "\n"
+	}
+	return lines
+}
+
+// diffBootEnv lists the added (+), removed (-) and changed (~) variables
+func diffBootEnv(before, after bootEnv) []string {
+	diff := []string{}
+	for _, name := range before.names() {
+		value, ok := after[name]
+		switch {
+		case !ok:
+			diff = append(diff, "-"+name+"="+before[name])
+		case value != before[name]:
+			diff = append(diff, "~"+name+"="+before[name]+" -> "+value)
+		}
+	}
+	for _, name := range after.names() {
+		if _, ok := before[name]; !ok {
+			diff = append(diff, "+"+name+"="+after[name])
+		}
+	}
+	return diff
+}
+
+// parseEnvNames validates the comma separated variable names given on the command line
+func parseEnvNames(value string) ([]string, error) {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !envNamePattern.MatchString(name) {
+			return nil, errors.Errorf("invalid U-Boot variable name %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// escapeEnvValue protects the command separators and variable references of a setenv value
+func escapeEnvValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, "$", `\$`).Replace(value)
+}
+
+// readEnv returns the whole U-Boot environment
+func (r *recipeRun) readEnv() (bootEnv, error) {
+	output, err := r.command("printenv", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	env := parseBootEnv(output)
+	if len(env) == 0 {
+		return nil, errors.Errorf("unexpected printenv output %q", strings.TrimSpace(output))
+	}
+	return env, nil
+}
+
+// setEnv sets or, with an empty value, deletes the variable and checks the result, saveenv is up to the caller
+func (r *recipeRun) setEnv(name, value string) error {
+	if !envNamePattern.MatchString(name) {
+		return errors.Errorf("invalid U-Boot variable name %q", name)
+	}
+	command := "setenv " + name
+	if value != "" {
+		command += " " + escapeEnvValue(value)
+	}
+	if _, err := r.command(command, 5*time.Second); err != nil {
+		return err
+	}
+	env, err := r.readEnv()
+	if err != nil {
+		return err
+	}
+	if env[name] != value {
+		return errors.Errorf("%s is %q after setenv, expected %q", name, env[name], value)
+	}
+	return nil
+}
+
+// saveEnv writes the environment to flash
+func (r *recipeRun) saveEnv() error {
+	output, err := r.command("saveenv", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(strings.ToLower(output), "error") {
+		return errors.Errorf("saveenv failed: %s", strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// snapshotEnv keeps the environment before the bootloader is flashed, with a copy in the backup directory
+func snapshotEnv(r *recipeRun) error {
+	env, err := r.readEnv()
+	if err != nil {
+		return err
+	}
+	r.envBefore = env
+	dir, err := r.backupDir()
+	if err != nil {
+		return err
+	}
+	log.Infof("U-Boot environment before flashing: %d variables", len(env))
+	return errors.Wrap(ioutil.WriteFile(filepath.Join(dir, "env-before.txt"), []byte(env.String()), 0644), "Write environment snapshot")
+}
+
+// restoreEnv logs the environment changes and restores the variables chosen on the command line
+func restoreEnv(r *recipeRun) error {
+	if r.envBefore == nil {
+		return errors.New("U-Boot environment was not saved before flashing")
+	}
+	after, err := r.readEnv()
+	if err != nil {
+		return err
+	}
+
+	restored := []string{}
+	for _, name := range r.ctx.restoreEnv {
+		value, ok := r.envBefore[name]
+		if !ok || after[name] == value {
+			continue
+		}
+		if err := r.setEnv(name, value); err != nil {
+			return errors.Wrapf(err, "Restore %s", name)
+		}
+		after[name] = value
+		restored = append(restored, name)
+	}
+	if len(restored) > 0 {
+		if err := r.saveEnv(); err != nil {
+			return err
+		}
+	}
+
+	diff := diffBootEnv(r.envBefore, after)
+	for _, line := range diff {
+		log.Infof("U-Boot environment: %s", line)
+	}
+	report.EnvDiff = diff
+	if dir, err := r.backupDir(); err == nil {
+		ioutil.WriteFile(filepath.Join(dir, "env-after.txt"), []byte(after.String()), 0644)
+	}
+	message := fmt.Sprintf("U-Boot environment: %d differences", len(diff))
+	if len(restored) > 0 {
+		message += ", restored " + strings.Join(restored, ", ")
+	}
+	r.ui.SetStatus(message)
+	log.Info(message)
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBootEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		env    bootEnv
+	}{
+		{"empty", "", bootEnv{}},
+		{"printenv", "printenv\r\nbaudrate=115200\r\nbootcmd=run addboard; bootm 0x9f050000\r\nethaddr=90:a2:da:f0:00:01\r\n\r\nEnvironment size: 96/65532 bytes\r\narduino> ",
+			bootEnv{"baudrate": "115200", "bootcmd": "run addboard; bootm 0x9f050000", "ethaddr": "90:a2:da:f0:00:01"}},
+		{"empty value", "stdin=\nboard=Yun\n", bootEnv{"stdin": "", "board": "Yun"}},
+		{"value with equals", "bootargs=console=ttyATH0,250000 rootfstype=squashfs\n", bootEnv{"bootargs": "console=ttyATH0,250000 rootfstype=squashfs"}},
+		{"not a variable", "## Error: \"foo\" not defined\narduino> printenv foo\n", bootEnv{}},
+	}
+	for _, test := range tests {
+		if env := parseBootEnv(test.output); !reflect.DeepEqual(env, test.env) {
+			t.Errorf("%s: got %v, expected %v", test.name, env, test.env)
+		}
+	}
+}
+
+func TestDiffBootEnv(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after bootEnv
+		diff          []string
+	}{
+		{"same", bootEnv{"board": "Yun"}, bootEnv{"board": "Yun"}, []string{}},
+		{"added", bootEnv{}, bootEnv{"board": "Yun"}, []string{"+board=Yun"}},
+		{"removed", bootEnv{"ethaddr": "90:a2:da:f0:00:01"}, bootEnv{}, []string{"-ethaddr=90:a2:da:f0:00:01"}},
+		{"changed", bootEnv{"bootdelay": "3"}, bootEnv{"bootdelay": "1"}, []string{"~bootdelay=3 -> 1"}},
+		{"emptied", bootEnv{"stdin": "serial"}, bootEnv{"stdin": ""}, []string{"~stdin=serial -> "}},
+		{"sorted", bootEnv{"b": "1", "c": "1", "a": "1"}, bootEnv{"d": "1", "c": "2", "a": "1"},
+			[]string{"-b=1", "~c=1 -> 2", "+d=1"}},
+	}
+	for _, test := range tests {
+		if diff := diffBootEnv(test.before, test.after); !reflect.DeepEqual(diff, test.diff) {
+			t.Errorf("%s: got %q, expected %q", test.name, diff, test.diff)
+		}
+	}
+}
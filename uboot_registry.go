@@ -0,0 +1,162 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// ubootCapabilities are the commands the recipes and the updater choose their steps from,
+// each is available to recipes as the {{uboot.NAME}} variable
+var ubootCapabilities = []string{"crc32", "tftpput", "wget", "loadb", "loady", "md", "flinfo", "ping", "saveenv"}
+
+// knownBootloader describes a bootloader met on the boards
+type knownBootloader struct {
+	name string
+	// prompt is the shell prompt without ">"
+	prompt string
+	// shipped is true for the bootloader flashed by the updater
+	shipped bool
+	// capabilities are expected from the help output, they are used when help is not available
+	capabilities []string
+}
+
+var knownBootloaders = []knownBootloader{
+	{
+		name:    "arduino-lede",
+		prompt:  "arduino",
+		shipped: true,
+		// the help table of tftp/u-boot-arduino-lede.bin (1.1.5-linino), it has neither tftpput nor wget
+		// so backups of this bootloader are always read with md.b
+		capabilities: []string{"crc32", "loadb", "loady", "md", "flinfo", "ping", "saveenv"},
+	},
+	{
+		name:         "linino",
+		prompt:       "linino",
+		capabilities: []string{"loadb", "md", "flinfo", "ping", "saveenv"},
+	},
+	{
+		name:         "atheros",
+		prompt:       "ar7240",
+		capabilities: []string{"loadb", "md", "flinfo", "ping", "saveenv"},
+	},
+}
+
+var (
+	ubootBannerPattern = regexp.MustCompile(`U-Boot [^\r\n]+`)
+	// U-Boot 1.1.x pads the names to 8 columns, "printenv- ..." has no space before the dash
+	helpLinePattern = regexp.MustCompile(`(?m)^([a-z][a-z0-9_.]*)[ \t]*- `)
+	envSizePattern  = regexp.MustCompile(`Environment size: (\d+)/(\d+) bytes`)
+)
+
+// ubootFingerprint identifies the bootloader running on the board
+type ubootFingerprint struct {
+	Name    string `json:"name"`
+	Banner  string `json:"banner,omitempty"`
+	Prompt  string `json:"prompt"`
+	Stop    string `json:"stop,omitempty"`
+	Current bool   `json:"current"`
+	// Commands are listed by help, Capabilities are the ubootCapabilities available
+	Commands     []string `json:"commands,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	// EnvUsed and EnvSize are printed by printenv, in bytes
+	EnvUsed int64 `json:"env_used,omitempty"`
+	EnvSize int64 `json:"env_size,omitempty"`
+}
+
+// has returns true if the bootloader has the capability
+func (f *ubootFingerprint) has(capability string) bool {
+	return f != nil && containsString(f.Capabilities, capability)
+}
+
+// matchBootloader returns the registered bootloader with the prompt, nil if unknown
+func matchBootloader(prompt string) *knownBootloader {
+	for i, known := range knownBootloaders {
+		if known.prompt == prompt {
+			return &knownBootloaders[i]
+		}
+	}
+	return nil
+}
+
+// parseHelp returns the sorted command names listed by help
+func parseHelp(output string) []string {
+	commands := []string{}
+	for _, match := range helpLinePattern.FindAllStringSubmatch(output, -1) {
+		if !containsString(commands, match[1]) {
+			commands = append(commands, match[1])
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// fingerprintUboot records the bootloader banner, prompt, stop string, commands and environment layout,
+// matches them against the registry and sets the {{uboot.*}} variables
+func fingerprintUboot(r *recipeRun) error {
+	fingerprint := &ubootFingerprint{Name: "unknown", Prompt: r.vars["shell"], Stop: r.vars["stop"]}
+	// the latest banner, the bootloader may have been flashed and restarted during the run
+	banner := ""
+	if banners := ubootBannerPattern.FindAllString(r.console.String(), -1); len(banners) > 0 {
+		banner = banners[len(banners)-1]
+	} else if output, err := r.command("version", 5*time.Second); err == nil {
+		banner = ubootBannerPattern.FindString(output)
+	}
+	fingerprint.Banner = strings.TrimSpace(banner)
+
+	help, err := r.command("help", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	fingerprint.Commands = parseHelp(help)
+	env, err := r.command("printenv", 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if match := envSizePattern.FindStringSubmatch(env); match != nil {
+		fingerprint.EnvUsed, _ = strconv.ParseInt(match[1], 10, 64)
+		fingerprint.EnvSize, _ = strconv.ParseInt(match[2], 10, 64)
+		if fingerprint.EnvSize > r.ctx.board.flash.envSize {
+			return errors.Errorf("U-Boot environment of %d bytes does not fit the %s bytes partition", fingerprint.EnvSize, hexAddr(r.ctx.board.flash.envSize))
+		}
+	}
+
+	known := matchBootloader(fingerprint.Prompt)
+	if known != nil {
+		fingerprint.Name = known.name
+		fingerprint.Current = known.shipped && known.prompt == r.ctx.board.uboot.shell
+	}
+	for _, capability := range ubootCapabilities {
+		available := containsString(fingerprint.Commands, capability)
+		if len(fingerprint.Commands) == 0 && known != nil {
+			// help may be compiled out, trust the registry
+			available = containsString(known.capabilities, capability)
+		} else if known != nil && available != containsString(known.capabilities, capability) {
+			log.Warnf("U-Boot %s: %s availability differs from the registry, help says %t", known.name, capability, available)
+		}
+		if available {
+			fingerprint.Capabilities = append(fingerprint.Capabilities, capability)
+		}
+		r.vars["uboot."+capability] = strconv.FormatBool(available)
+	}
+	r.vars["uboot.name"] = fingerprint.Name
+	r.vars["uboot.current"] = strconv.FormatBool(fingerprint.Current)
+	r.uboot = fingerprint
+	report.Uboot = fingerprint
+	log.Infof("U-Boot %s (%s), prompt %q, current %t, capabilities %s", fingerprint.Name, fingerprint.Banner, fingerprint.Prompt, fingerprint.Current, strings.Join(fingerprint.Capabilities, ", "))
+	return nil
+}
+
+// ubootVariables are the {{uboot.*}} variables before the fingerprint, nothing is assumed available
+func ubootVariables() map[string]string {
+	vars := map[string]string{"uboot.name": "unknown", "uboot.current": "false"}
+	for _, capability := range ubootCapabilities {
+		vars["uboot."+capability] = "false"
+	}
+	return vars
+}
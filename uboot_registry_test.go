@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHelp(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		commands []string
+	}{
+		{"empty", "", []string{}},
+		{"padded", "help\r\n?       - alias for 'help'\r\ncp      - memory copy\r\ncrc32   - checksum calculation\r\nmd      - memory display\r\narduino> ",
+			[]string{"cp", "crc32", "md"}},
+		{"no space before the dash", "printenv- print environment variables\nsetenv  - set environment variables\n",
+			[]string{"printenv", "setenv"}},
+		{"dotted names", "cp.b    - memory copy\nbootm   - boot application image from memory\n", []string{"bootm", "cp.b"}},
+		{"usage lines", "tftpput - upload a file via network using TFTP protocol\n    - with arguments\ntftpput addr size file\n",
+			[]string{"tftpput"}},
+		{"listed twice", "md      - memory display\nmd      - memory display\n", []string{"md"}},
+		{"unknown command", "Unknown command 'help' - try 'help'\n", []string{}},
+	}
+	for _, test := range tests {
+		if commands := parseHelp(test.output); !reflect.DeepEqual(commands, test.commands) {
+			t.Errorf("%s: got %q, expected %q", test.name, commands, test.commands)
+		}
+	}
+}
+
+func TestMatchBootloader(t *testing.T) {
+	for prompt, name := range map[string]string{"arduino": "arduino-lede", "linino": "linino", "ar7240": "atheros", "": "", "uboot": ""} {
+		known := matchBootloader(prompt)
+		if known == nil && name != "" || known != nil && known.name != name {
+			t.Errorf("%q: got %v, expected %q", prompt, known, name)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.bug.st/serial.v1/enumerator"
+)
+
+const usbDatabaseFileName = "usb_devices.json"
+
+// usbDevice is an entry of the USB device database
+type usbDevice struct {
+	// Name is shown when the device is found
+	Name string `json:"name"`
+	VID  string `json:"vid"`
+	PID  string `json:"pid"`
+	// Mode is "bootloader" for the PID used by the bootloader or "sketch" for the PID used by a running sketch
+	Mode string `json:"mode"`
+	// Profile is the name of the board profile to use with the device
+	Profile string `json:"profile"`
+}
+
+// usbDatabase lists the devices suitable for upload, later entries override earlier ones with the same ids
+type usbDatabase []usbDevice
+
+var usbIDFormat = regexp.MustCompile(`^[0-9a-fA-F]{4}$`)
+
+// loadUsbDatabase reads and merges the given JSON files, every entry must refer to a registered board profile
+func loadUsbDatabase(paths ...string) (usbDatabase, error) {
+	db := usbDatabase{}
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Read USB device database")
+		}
+		devices := []usbDevice{}
+		if err := json.Unmarshal(content, &devices); err != nil {
+			return nil, errors.Wrapf(err, "Parse USB device database %s", path)
+		}
+		for _, device := range devices {
+			if err := db.add(device); err != nil {
+				return nil, errors.Wrapf(err, "USB device database %s", path)
+			}
+		}
+	}
+	return db, nil
+}
+
+// add validates the device and appends it to the database
+func (db *usbDatabase) add(device usbDevice) error {
+	if !usbIDFormat.MatchString(device.VID) || !usbIDFormat.MatchString(device.PID) {
+		return errors.Errorf("invalid USB id %s:%s", device.VID, device.PID)
+	}
+	if device.Mode != "bootloader" && device.Mode != "sketch" {
+		return errors.Errorf("device %s:%s has mode %q, expected bootloader or sketch", device.VID, device.PID, device.Mode)
+	}
+	profile, err := findBoardProfile(device.Profile)
+	if err != nil {
+		return errors.Wrapf(err, "device %s:%s", device.VID, device.PID)
+	}
+	device.Profile = profile.name
+	if device.Name == "" {
+		device.Name = profile.name
+	}
+	device.VID = strings.ToLower(device.VID)
+	device.PID = strings.ToLower(device.PID)
+	*db = append(*db, device)
+	return nil
+}
+
+// lookup returns the database entry matching the port, nil if the port is unknown
+func (db usbDatabase) lookup(port *enumerator.PortDetails) *usbDevice {
+	for i := len(db) - 1; i >= 0; i-- {
+		if strings.EqualFold(port.VID, db[i].VID) && strings.EqualFold(port.PID, db[i].PID) {
+			return &db[i]
+		}
+	}
+	return nil
+}
+
+// usbDeviceFlags collects the devices given on the command line as vid:pid:profile[:mode[:name]]
+type usbDeviceFlags []usbDevice
+
+func (f *usbDeviceFlags) String() string {
+	values := []string{}
+	for _, device := range *f {
+		values = append(values, device.VID+":"+device.PID+":"+device.Profile+":"+device.Mode)
+	}
+	return strings.Join(values, ",")
+}
+
+func (f *usbDeviceFlags) Set(value string) error {
+	fields := strings.SplitN(value, ":", 5)
+	if len(fields) < 3 {
+		return errors.Errorf("expected vid:pid:profile[:mode[:name]], got %q", value)
+	}
+	device := usbDevice{VID: fields[0], PID: fields[1], Profile: fields[2], Mode: "sketch"}
+	if len(fields) > 3 {
+		device.Mode = fields[3]
+	}
+	if len(fields) > 4 {
+		device.Name = fields[4]
+	}
+	*f = append(*f, device)
+	return nil
+}
+
+// usbDatabasePaths returns the shipped database followed by the user one, if any
+func usbDatabasePaths(execDir, userPath string) []string {
+	paths := []string{filepath.Join(execDir, usbDatabaseFileName)}
+	if userPath != "" {
+		paths = append(paths, userPath)
+	}
+	return paths
+}